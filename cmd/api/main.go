@@ -1,13 +1,32 @@
-
 package main
 
 import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+
+	"go-image-processing-service/internal/config"
 	"go-image-processing-service/internal/server"
 )
 
 // main is the entry point for the image processing service.
-// It creates and starts a new server instance.
+// It loads the configuration, then creates and starts a new server instance that
+// runs until it receives SIGINT or SIGTERM.
 func main() {
-	srv := server.New("8080")
-	srv.Start()
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	srv, err := server.New(cfg)
+	if err != nil {
+		log.Fatalf("Could not create server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -1,5 +1,23 @@
 module go-image-processing-service
 
-go 1.23.1
+go 1.25.0
 
-require github.com/disintegration/gift v1.2.1
+require (
+	github.com/HugoSmits86/nativewebp v0.9.3
+	github.com/disintegration/gift v1.2.1
+	github.com/prometheus/client_golang v1.24.1
+	golang.org/x/image v0.24.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.2 // indirect
+	github.com/prometheus/common v0.70.1 // indirect
+	github.com/prometheus/procfs v0.21.1 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	google.golang.org/protobuf v1.36.11 // indirect
+)
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/disintegration/gift"
+
+	"go-image-processing-service/internal/logging"
+)
+
+// adjustmentOrder lists the color adjustments in the order AdjustHandler applies them.
+// Each is also a /process operation of the same name, registered in pipelineOps.
+var adjustmentOrder = []string{
+	"gamma", "brightness", "contrast", "saturation", "hue", "colorize", "grayscale", "sepia", "invert",
+}
+
+// floatParam parses a required numeric parameter and checks that it lies in [lo, hi].
+func floatParam(params url.Values, name string, lo, hi float64) (float32, error) {
+	value, err := strconv.ParseFloat(params.Get(name), 64)
+	if err != nil || math.IsNaN(value) || value < lo || value > hi {
+		return 0, fmt.Errorf("invalid '%s' parameter. Must be a number between %g and %g", name, lo, hi)
+	}
+	return float32(value), nil
+}
+
+// optionalFloatParam is like floatParam but returns def when the parameter is absent.
+func optionalFloatParam(params url.Values, name string, lo, hi, def float64) (float32, error) {
+	if params.Get(name) == "" {
+		return float32(def), nil
+	}
+	return floatParam(params, name, lo, hi)
+}
+
+// toggleParam reads an on/off parameter. An empty value counts as on, so that a bare
+// pipeline step such as "grayscale" applies the adjustment.
+func toggleParam(params url.Values, name string) (bool, error) {
+	v := params.Get(name)
+	if v == "" {
+		return true, nil
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid '%s' parameter. Must be true or false", name)
+	}
+	return on, nil
+}
+
+// brightnessFilter builds a brightness filter from `brightness`, a percentage from -100 to 100.
+func brightnessFilter(params url.Values) (gift.Filter, error) {
+	percentage, err := floatParam(params, "brightness", -100, 100)
+	if err != nil {
+		return nil, err
+	}
+	return gift.Brightness(percentage), nil
+}
+
+// contrastFilter builds a contrast filter from `contrast`, a percentage from -100 to 100.
+func contrastFilter(params url.Values) (gift.Filter, error) {
+	percentage, err := floatParam(params, "contrast", -100, 100)
+	if err != nil {
+		return nil, err
+	}
+	return gift.Contrast(percentage), nil
+}
+
+// gammaFilter builds a gamma correction filter from `gamma`, from 0.01 to 10.
+// Values below 1 darken the image and values above 1 lighten it.
+func gammaFilter(params url.Values) (gift.Filter, error) {
+	gamma, err := floatParam(params, "gamma", 0.01, 10)
+	if err != nil {
+		return nil, err
+	}
+	return gift.Gamma(gamma), nil
+}
+
+// saturationFilter builds a saturation filter from `saturation`, a percentage from
+// -100 (fully desaturated) to 500.
+func saturationFilter(params url.Values) (gift.Filter, error) {
+	percentage, err := floatParam(params, "saturation", -100, 500)
+	if err != nil {
+		return nil, err
+	}
+	return gift.Saturation(percentage), nil
+}
+
+// hueFilter builds a hue rotation filter from `hue`, in degrees from -180 to 180.
+func hueFilter(params url.Values) (gift.Filter, error) {
+	shift, err := floatParam(params, "hue", -180, 180)
+	if err != nil {
+		return nil, err
+	}
+	return gift.Hue(shift), nil
+}
+
+// colorizeFilter builds a colorize filter from `colorize`, the target hue in degrees
+// (0-360), with optional `colorizeSaturation` (0-100, default 100) and `colorizeAmount`
+// (0-100, default 100) controlling how strongly the image is tinted.
+func colorizeFilter(params url.Values) (gift.Filter, error) {
+	hue, err := floatParam(params, "colorize", 0, 360)
+	if err != nil {
+		return nil, err
+	}
+	saturation, err := optionalFloatParam(params, "colorizeSaturation", 0, 100, 100)
+	if err != nil {
+		return nil, err
+	}
+	amount, err := optionalFloatParam(params, "colorizeAmount", 0, 100, 100)
+	if err != nil {
+		return nil, err
+	}
+	return gift.Colorize(hue, saturation, amount), nil
+}
+
+// grayscaleFilter builds a grayscale filter, or returns nil when `grayscale` is false.
+func grayscaleFilter(params url.Values) (gift.Filter, error) {
+	on, err := toggleParam(params, "grayscale")
+	if err != nil || !on {
+		return nil, err
+	}
+	return gift.Grayscale(), nil
+}
+
+// sepiaFilter builds a sepia filter from `sepia`, a percentage from 0 to 100 (default 100).
+func sepiaFilter(params url.Values) (gift.Filter, error) {
+	percentage, err := optionalFloatParam(params, "sepia", 0, 100, 100)
+	if err != nil {
+		return nil, err
+	}
+	return gift.Sepia(percentage), nil
+}
+
+// invertFilter builds a color inversion filter, or returns nil when `invert` is false.
+func invertFilter(params url.Values) (gift.Filter, error) {
+	on, err := toggleParam(params, "invert")
+	if err != nil || !on {
+		return nil, err
+	}
+	return gift.Invert(), nil
+}
+
+// adjustFilters builds the filters for every adjustment present in params, in the
+// order of adjustmentOrder.
+func adjustFilters(params url.Values) ([]gift.Filter, error) {
+	var filters []gift.Filter
+	for _, name := range adjustmentOrder {
+		if !params.Has(name) {
+			continue
+		}
+		filter, err := pipelineOps[name].build(params)
+		if err != nil {
+			return nil, err
+		}
+		if filter != nil {
+			filters = append(filters, filter)
+		}
+	}
+	return filters, nil
+}
+
+// AdjustHandler applies color adjustments to an uploaded image.
+//
+// It expects a POST request with an "image" form field. Any of the following query
+// parameters may be combined; they are applied in this order through a single gift chain:
+//   - `gamma` (0.01-10), `brightness` and `contrast` (-100 to 100 percent)
+//   - `saturation` (-100 to 500 percent) and `hue` (-180 to 180 degrees)
+//   - `colorize` (hue, 0-360) with optional `colorizeSaturation` and `colorizeAmount` (0-100)
+//   - `grayscale` and `invert` (booleans) and `sepia` (0-100 percent)
+//
+// At least one adjustment is required. The result keeps the source format unless
+// overridden (see ResizeHandler), and animated GIFs are adjusted frame by frame.
+func AdjustHandler(w http.ResponseWriter, r *http.Request) {
+	src, err := decodeImageFromRequest(r)
+	if err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	params := r.URL.Query()
+	if !hasAdjustment(params) {
+		http.Error(w, "no adjustment given. Supported: brightness, contrast, gamma, saturation, hue, colorize, grayscale, sepia, invert", http.StatusBadRequest)
+		return
+	}
+
+	filters, err := adjustFilters(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format, err := outputFormat(r, src)
+	if err != nil {
+		http.Error(w, err.Error(), outputFormatStatus(err))
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+
+	logging.FromContext(r.Context()).Debug("Applying color adjustments", "count", len(filters))
+
+	dst := transformImage(src, format, filters...)
+
+	if err := writeImage(w, dst, format, encodeOptionsFromParams(params)); err != nil {
+		http.Error(w, "Could not encode adjusted image", http.StatusInternalServerError)
+	}
+}
+
+// hasAdjustment reports whether params name at least one adjustment.
+func hasAdjustment(params url.Values) bool {
+	for _, name := range adjustmentOrder {
+		if params.Has(name) {
+			return true
+		}
+	}
+	return false
+}
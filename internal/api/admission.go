@@ -0,0 +1,184 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// errOverloaded is returned when an image cannot be admitted for processing because
+// too much work is in progress and the queue is full or the wait timed out.
+var errOverloaded = errors.New("server is busy, retry later")
+
+// admissionController bounds the image work running at once: at most maxJobs images are
+// processed concurrently, and their pixels add up to at most maxPixels, a proxy for the
+// memory they use. Requests that cannot start wait in a FIFO queue of at most maxQueue
+// entries for up to timeout.
+type admissionController struct {
+	maxJobs   int
+	maxPixels int64 // 0 means no pixel budget
+	maxQueue  int
+	timeout   time.Duration
+
+	mu     sync.Mutex
+	jobs   int
+	pixels int64
+	queue  []*admissionWaiter
+}
+
+// admissionWaiter is a queued request; ready is closed once it is admitted.
+type admissionWaiter struct {
+	weight int64
+	ready  chan struct{}
+}
+
+// newAdmissionController returns the controller for s, or nil if concurrency is not
+// limited.
+func newAdmissionController(s Settings) *admissionController {
+	if s.MaxConcurrentJobs <= 0 {
+		return nil
+	}
+	return &admissionController{
+		maxJobs:   s.MaxConcurrentJobs,
+		maxPixels: int64(s.MaxConcurrentMegapixels * 1e6),
+		maxQueue:  s.QueueDepth,
+		timeout:   s.QueueTimeout,
+	}
+}
+
+// weight returns the share of the pixel budget an image of the given pixel count takes.
+// Images larger than the whole budget take all of it, so that they run alone.
+func (c *admissionController) weight(pixels int64) int64 {
+	if c.maxPixels == 0 {
+		return 0
+	}
+	return min(pixels, c.maxPixels)
+}
+
+// fits reports whether a job of the given weight can start now. c.mu must be held.
+func (c *admissionController) fits(weight int64) bool {
+	return c.jobs < c.maxJobs && (c.maxPixels == 0 || c.pixels+weight <= c.maxPixels)
+}
+
+// acquire waits until a job of the given weight may start, in arrival order. It returns
+// errOverloaded if the queue is full, the wait exceeds the queue timeout or ctx is done
+// first; in the last case the error also wraps the context's error.
+func (c *admissionController) acquire(ctx context.Context, weight int64) error {
+	c.mu.Lock()
+	if len(c.queue) == 0 && c.fits(weight) {
+		c.jobs++
+		c.pixels += weight
+		c.mu.Unlock()
+		return nil
+	}
+	if len(c.queue) >= c.maxQueue {
+		c.mu.Unlock()
+		return errOverloaded
+	}
+	w := &admissionWaiter{weight: weight, ready: make(chan struct{})}
+	c.queue = append(c.queue, w)
+	c.mu.Unlock()
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-timer.C:
+		err = errOverloaded
+	case <-ctx.Done():
+		err = fmt.Errorf("%w: %w", errOverloaded, ctx.Err())
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-w.ready:
+		// Admitted while giving up; keep the slot since the caller will release it.
+		return nil
+	default:
+	}
+	c.queue = slices.DeleteFunc(c.queue, func(q *admissionWaiter) bool { return q == w })
+	// Leaving the head of the queue may let the next waiters in.
+	c.admitQueued()
+	return err
+}
+
+// release ends a job of the given weight and admits the waiters that now fit.
+func (c *admissionController) release(weight int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.jobs--
+	c.pixels -= weight
+	c.admitQueued()
+}
+
+// admitQueued admits waiters from the head of the queue while they fit. c.mu must be held.
+func (c *admissionController) admitQueued() {
+	for len(c.queue) > 0 && c.fits(c.queue[0].weight) {
+		w := c.queue[0]
+		c.queue = c.queue[1:]
+		c.jobs++
+		c.pixels += w.weight
+		close(w.ready)
+	}
+}
+
+// admission is the active controller; nil when concurrency is not limited.
+var admission *admissionController
+
+// admissionTicketKey is the request context key of the request's admissionTicket.
+type admissionTicketKey struct{}
+
+// admissionTicket records the admission held by a request so it can be released when
+// the handler returns.
+type admissionTicket struct {
+	controller *admissionController
+	held       bool
+	weight     int64
+}
+
+// Admit wraps the image handlers so that their processing counts against the
+// concurrency limits of Settings. Admission is requested once the dimensions of the
+// uploaded image are known, before it is decoded, and is held until the handler returns.
+// Requests that cannot be admitted in time get 503 with a Retry-After header.
+func Admit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if admission == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ticket := &admissionTicket{controller: admission}
+		defer func() {
+			if ticket.held {
+				ticket.controller.release(ticket.weight)
+			}
+		}()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), admissionTicketKey{}, ticket)))
+	})
+}
+
+// admit waits for the request of ctx to be admitted to process an image of the given
+// pixel count. It does nothing outside Admit or when the request is already admitted.
+func admit(ctx context.Context, pixels int64) error {
+	if ctx == nil {
+		return nil
+	}
+	ticket, ok := ctx.Value(admissionTicketKey{}).(*admissionTicket)
+	if !ok || ticket.held {
+		return nil
+	}
+	weight := ticket.controller.weight(pixels)
+	if err := ticket.controller.acquire(ctx, weight); err != nil {
+		return err
+	}
+	ticket.held = true
+	ticket.weight = weight
+	return nil
+}
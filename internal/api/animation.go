@@ -0,0 +1,129 @@
+package api
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+
+	"github.com/disintegration/gift"
+)
+
+// applyFiltersToGIF runs every frame of an animated GIF through the same gift chain.
+//
+// GIF frames are often partial updates drawn over the previous frames, so each frame is
+// first composited onto a full canvas according to the disposal method of the frames
+// before it. The filtered canvas is then mapped onto a palette by framePalette, keeping
+// its transparent pixels transparent. Since every output frame is a complete picture,
+// frames are disposed to the background before the next one is drawn. Frame delays,
+// loop count and the global palette are carried over.
+func applyFiltersToGIF(anim *gif.GIF, filters ...gift.Filter) *gif.GIF {
+	g := gift.New(filters...)
+
+	canvas := image.NewRGBA(image.Rect(0, 0, anim.Config.Width, anim.Config.Height))
+	outBounds := g.Bounds(canvas.Bounds())
+
+	out := &gif.GIF{
+		Image:           make([]*image.Paletted, 0, len(anim.Image)),
+		Delay:           anim.Delay,
+		Disposal:        make([]byte, 0, len(anim.Image)),
+		LoopCount:       anim.LoopCount,
+		BackgroundIndex: anim.BackgroundIndex,
+		Config: image.Config{
+			ColorModel: anim.Config.ColorModel,
+			Width:      outBounds.Dx(),
+			Height:     outBounds.Dy(),
+		},
+	}
+
+	for i, frame := range anim.Image {
+		disposal := byte(0)
+		if i < len(anim.Disposal) {
+			disposal = anim.Disposal[i]
+		}
+
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(canvas.Bounds())
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		filtered := image.NewRGBA(outBounds)
+		g.Draw(filtered, canvas)
+
+		out.Image = append(out.Image, quantizeFrame(filtered, frame.Palette))
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return out
+}
+
+// quantizeFrame maps img onto the palette framePalette picks for it, dithering colors
+// that are not in the palette and keeping transparent pixels transparent.
+func quantizeFrame(img *image.RGBA, source color.Palette) *image.Paletted {
+	palette, transparent := framePalette(img, source)
+	paletted := image.NewPaletted(img.Bounds(), palette)
+	draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), img, img.Bounds().Min)
+	if transparent >= 0 {
+		// Dithering may leave transparent pixels on a color; clear them all.
+		for p := 3; p < len(img.Pix); p += 4 {
+			if img.Pix[p] < 0x80 {
+				paletted.Pix[p/4] = uint8(transparent)
+			}
+		}
+	}
+	return paletted
+}
+
+// framePalette returns the palette a filtered frame is quantized onto, and the index of
+// its transparent entry, or -1 if img has no transparent pixels (alpha below half).
+//
+// When img has few enough colors they become the palette, so that the colors of earlier
+// frames composited into it, and of padding, are kept exactly. Otherwise the source
+// frame's palette is used. Either way a transparent entry is added when needed,
+// replacing the last color of a full palette.
+func framePalette(img *image.RGBA, source color.Palette) (color.Palette, int) {
+	transparent := false
+	exact := true
+	seen := map[color.RGBA]bool{}
+	var colors color.Palette
+	for i := 0; i < len(img.Pix); i += 4 {
+		c := color.RGBA{R: img.Pix[i], G: img.Pix[i+1], B: img.Pix[i+2], A: img.Pix[i+3]}
+		switch {
+		case c.A < 0x80:
+			transparent = true
+		case !exact || seen[c]:
+		case c.A != 0xFF || len(colors) == 255:
+			exact = false
+		default:
+			seen[c] = true
+			colors = append(colors, c)
+		}
+	}
+
+	palette := colors
+	if !exact || len(colors) == 0 {
+		palette = append(color.Palette(nil), source...)
+	}
+	if !transparent {
+		return palette, -1
+	}
+	for i, c := range palette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return palette, i
+		}
+	}
+	if len(palette) == 256 {
+		palette = palette[:255]
+	}
+	return append(palette, color.RGBA{}), len(palette)
+}
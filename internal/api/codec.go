@@ -0,0 +1,313 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/HugoSmits86/nativewebp"
+	_ "golang.org/x/image/webp" // Import for WebP decoding side-effects
+
+	"go-image-processing-service/internal/logging"
+)
+
+// defaultWebPQuality is the quality used for lossy WebP output when none is given.
+const defaultWebPQuality = 75
+
+// decodedImage is an uploaded image along with the details learned while decoding it.
+type decodedImage struct {
+	// image is the decoded image. For animations it is the first frame.
+	image image.Image
+	// format is the format name reported by image.Decode, e.g. "jpeg", "png", "webp" or "gif".
+	format string
+	// anim holds every frame of an animated GIF and is nil for still images.
+	anim *gif.GIF
+	// meta holds the metadata payloads of the uploaded file.
+	meta imageMetadata
+	// autorotated records that the EXIF orientation has been applied to the pixels.
+	autorotated bool
+	// ctx is the context of the request the image belongs to, if any; measurements of
+	// the work on the image are logged with it.
+	ctx context.Context
+}
+
+// decodeOptions controls how decodeImage prepares an uploaded image.
+type decodeOptions struct {
+	// autorotate applies the EXIF Orientation of JPEG uploads so the image is upright
+	// before any operation runs.
+	autorotate bool
+	// ctx is the context of the request the image belongs to, used to wait for
+	// admission (see Admit). Images decoded without one are not admitted.
+	ctx context.Context
+}
+
+// decodeOptionsFromRequest reads the decode options from the query string.
+// Auto-rotation is on unless `autorotate=false` is given.
+func decodeOptionsFromRequest(r *http.Request) decodeOptions {
+	opts := decodeOptions{autorotate: true, ctx: r.Context()}
+	if autorotate, err := strconv.ParseBool(r.URL.Query().Get("autorotate")); err == nil {
+		opts.autorotate = autorotate
+	}
+	return opts
+}
+
+// decodeImage reads an uploaded image and decodes it. Images larger than the configured
+// MaxWidth, MaxHeight or MaxMegapixels are rejected with an *imageLimitError. Decoding
+// waits for admission by pixel count, over all frames of a GIF, when the request is
+// subject to Admit.
+// Animated GIFs are decoded in full so that every frame can be processed. For GIFs,
+// image is the first frame on a canvas the size of the logical screen.
+func decodeImage(r io.Reader, opts decodeOptions) (*decodedImage, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	config, configFormat, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	// Reject oversized images from their header, before allocating any pixels, so that
+	// a small file declaring huge dimensions cannot exhaust memory. Every frame of a GIF
+	// is decoded, so its frames are counted against the limit too.
+	frames := 1
+	if configFormat == "gif" {
+		frames = max(1, gifFrameCount(data))
+	}
+	if err := checkDimensions("image", config.Width, config.Height, frames); err != nil {
+		return nil, err
+	}
+	if err := admit(opts.ctx, int64(config.Width)*int64(config.Height)*int64(frames)); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if settings.Recorder != nil {
+		settings.Recorder.ObserveSourceFormat(format)
+	}
+	defer observeStage(opts.ctx, "decode", start)
+	logging.AddFields(opts.ctx, "source_format", format, "source_width", config.Width, "source_height", config.Height)
+
+	decoded := &decodedImage{image: img, format: format, meta: extractMetadata(data, format), ctx: opts.ctx}
+
+	if opts.autorotate && format == "jpeg" {
+		if filter := orientationFilter(exifOrientation(decoded.meta.exif)); filter != nil {
+			decoded.image = applyFilters(img, filter)
+			decoded.autorotated = true
+		}
+	}
+
+	if format == "gif" {
+		if frames > 1 {
+			anim, err := gif.DecodeAll(bytes.NewReader(data))
+			if err == nil && len(anim.Image) > 1 {
+				decoded.anim = anim
+			}
+		}
+		// The first frame may cover only part of the logical screen. Place it on a
+		// screen-sized canvas so that every operation sees the geometry that
+		// applyFiltersToGIF works with.
+		if screen := image.Rect(0, 0, config.Width, config.Height); img.Bounds() != screen {
+			canvas := image.NewRGBA(screen)
+			draw.Draw(canvas, img.Bounds(), img, img.Bounds().Min, draw.Src)
+			decoded.image = canvas
+		}
+	}
+
+	return decoded, nil
+}
+
+// frames returns the number of frames of the image: the frame count of an animation,
+// or 1 for still images.
+func (d *decodedImage) frames() int {
+	if d.anim != nil {
+		return len(d.anim.Image)
+	}
+	return 1
+}
+
+// exifOrientation returns the Orientation of an EXIF payload, or 1 if there is none.
+func exifOrientation(tiff []byte) int {
+	if tiff == nil {
+		return 1
+	}
+	x, err := parseEXIF(tiff)
+	if err != nil {
+		return 1
+	}
+	return x.orientation()
+}
+
+// encodeOptions controls how encodeImage writes an image.
+type encodeOptions struct {
+	// quality (1-100) applies to JPEG output and to quantized WebP; 0 selects the default.
+	quality int
+	// lossless, when false, quantizes WebP colors before the (always lossless) encode.
+	lossless bool
+	// metadata is one of the metadata* modes and selects which source metadata is copied.
+	metadata string
+}
+
+// encodeOptionsFromParams reads the `quality`, `lossless` and `metadata` parameters.
+// Missing or invalid values fall back to the defaults: encoder-default quality,
+// unquantized WebP unless `lossless=false` is given, and stripped metadata.
+func encodeOptionsFromParams(params url.Values) encodeOptions {
+	opts := encodeOptions{lossless: true, metadata: metadataStrip}
+
+	if quality, err := strconv.Atoi(params.Get("quality")); err == nil && quality >= 1 && quality <= 100 {
+		opts.quality = quality
+	}
+	if lossless, err := strconv.ParseBool(params.Get("lossless")); err == nil {
+		opts.lossless = lossless
+	}
+	switch mode := params.Get("metadata"); mode {
+	case metadataKeep, metadataStrip, metadataStripGPS:
+		opts.metadata = mode
+	}
+
+	return opts
+}
+
+// encodeImage writes img to w in the given format.
+//
+// Supported formats are "jpeg" (or "jpg"), "png", "webp" and "gif".
+func encodeImage(w io.Writer, img image.Image, format string, opts encodeOptions) error {
+	switch format {
+	case "jpeg", "jpg":
+		quality := opts.quality
+		if quality == 0 {
+			quality = settings.DefaultJPEGQuality
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "png":
+		return png.Encode(w, img)
+	case "gif":
+		// Quantize like animation frames do, so that transparency survives; gif.Encode
+		// alone would map transparent pixels onto opaque Plan 9 colors.
+		rgba := image.NewRGBA(img.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), img, rgba.Bounds().Min, draw.Src)
+		source := palette.Plan9
+		if paletted, ok := img.(*image.Paletted); ok {
+			source = paletted.Palette
+		}
+		return gif.Encode(w, quantizeFrame(rgba, source), nil)
+	case "webp":
+		if !opts.lossless {
+			quality := opts.quality
+			if quality == 0 {
+				quality = defaultWebPQuality
+			}
+			img = quantizeForWebP(img, quality)
+		}
+		return nativewebp.Encode(w, img, nil)
+	default:
+		return fmt.Errorf("unsupported output format %q", format)
+	}
+}
+
+// writeImage encodes img in the given format, embeds the source metadata selected by
+// opts.metadata and writes the result with the matching Content-Type header.
+// Animations are written with every frame when the output format is GIF; other
+// formats receive the first frame.
+//
+// The image is encoded into memory first so that an encoding failure can still be
+// reported as an error response.
+func writeImage(w http.ResponseWriter, img *decodedImage, format string, opts encodeOptions) error {
+	start := time.Now()
+	var buf bytes.Buffer
+	var err error
+	if img.anim != nil && format == "gif" {
+		err = gif.EncodeAll(&buf, img.anim)
+	} else {
+		err = encodeImage(&buf, img.image, format, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	out := buf.Bytes()
+	if meta := img.meta.selected(opts.metadata, img.autorotated); !meta.empty() {
+		out = embedMetadata(out, format, meta)
+	}
+	observeStage(img.ctx, "encode", start)
+	b := img.image.Bounds()
+	logging.AddFields(img.ctx, "output_format", format, "output_width", b.Dx(), "output_height", b.Dy(), "output_bytes", len(out))
+
+	w.Header().Set("Content-Type", mediaTypeOf(format))
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	_, err = w.Write(out)
+	return err
+}
+
+// isSupportedFormat reports whether encodeImage can produce the given format.
+func isSupportedFormat(format string) bool {
+	switch format {
+	case "jpeg", "jpg", "png", "webp", "gif":
+		return true
+	}
+	return false
+}
+
+// quantizeForWebP prepares an image for `lossless=false` WebP output.
+//
+// There is no pure Go VP8 (lossy WebP) encoder, so the output stays lossless VP8L and
+// is made smaller the way libwebp's near-lossless mode works: the low bits of each color
+// channel are rounded away according to quality before encoding. This usually shrinks
+// photos, though not as far as a lossy encoder would, and keeps the binary free of cgo.
+// Alpha is left untouched.
+func quantizeForWebP(img image.Image, quality int) image.Image {
+	var bits uint
+	switch {
+	case quality >= 100:
+		return img
+	case quality >= 80:
+		bits = 1
+	case quality >= 60:
+		bits = 2
+	case quality >= 40:
+		bits = 3
+	case quality >= 20:
+		bits = 4
+	default:
+		bits = 5
+	}
+
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			c.R = quantizeChannel(c.R, bits)
+			c.G = quantizeChannel(c.G, bits)
+			c.B = quantizeChannel(c.B, bits)
+			dst.SetNRGBA(x-b.Min.X, y-b.Min.Y, c)
+		}
+	}
+	return dst
+}
+
+// quantizeChannel rounds v to the nearest multiple of 1<<bits, clamped to 255.
+func quantizeChannel(v uint8, bits uint) uint8 {
+	step := 1 << bits
+	q := (int(v) + step/2) / step * step
+	if q > 255 {
+		q = 255 &^ (step - 1)
+	}
+	return uint8(q)
+}
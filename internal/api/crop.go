@@ -0,0 +1,148 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/gift"
+)
+
+// cropLength is a crop coordinate or size, either in pixels or as a percentage of the
+// corresponding source dimension.
+type cropLength struct {
+	value   float64
+	percent bool
+	set     bool
+}
+
+// parseCropLength parses a crop parameter such as "120" or "12.5%". Pixel values must be
+// integers. An empty string yields an unset length.
+func parseCropLength(name, s string) (cropLength, error) {
+	if s == "" {
+		return cropLength{}, nil
+	}
+	if number, ok := strings.CutSuffix(s, "%"); ok {
+		value, err := strconv.ParseFloat(number, 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return cropLength{}, fmt.Errorf("invalid crop parameter '%s'. Must be an integer or a percentage", name)
+		}
+		return cropLength{value: value, percent: true, set: true}, nil
+	}
+	value, err := strconv.Atoi(s)
+	if err != nil {
+		return cropLength{}, fmt.Errorf("invalid crop parameter '%s'. Must be an integer or a percentage", name)
+	}
+	return cropLength{value: float64(value), set: true}, nil
+}
+
+// resolve converts the length to pixels for a source dimension of total pixels.
+func (l cropLength) resolve(total int) int {
+	if l.percent {
+		return int(math.Round(l.value / 100 * float64(total)))
+	}
+	return int(l.value)
+}
+
+// parseAspect parses an aspect ratio written as "W:H", such as "16:9".
+func parseAspect(s string) (image.Point, error) {
+	w, h, ok := strings.Cut(s, ":")
+	aw, errW := strconv.Atoi(w)
+	ah, errH := strconv.Atoi(h)
+	if !ok || errW != nil || errH != nil || aw <= 0 || ah <= 0 {
+		return image.Point{}, errors.New("invalid 'aspect' parameter. Use W:H with positive integers, e.g. 16:9")
+	}
+	return image.Pt(aw, ah), nil
+}
+
+// cropRegionFilter crops a region whose position and size may depend on the source
+// dimensions: percentages, a gravity instead of explicit coordinates, or an aspect ratio
+// instead of one or both sizes.
+type cropRegionFilter struct {
+	x, y, width, height cropLength
+	// aspect is the width:height ratio used for missing sizes; zero when not given.
+	aspect image.Point
+	// anchor positions the region along the axes whose coordinate is not given.
+	anchor gift.Anchor
+}
+
+// rect returns the crop region for a source of the given size, relative to its origin.
+// The region is not clipped; see validate.
+func (f cropRegionFilter) rect(srcSize image.Point) image.Rectangle {
+	var width, height int
+	switch {
+	case f.width.set && f.height.set:
+		width, height = f.width.resolve(srcSize.X), f.height.resolve(srcSize.Y)
+	case f.width.set:
+		width = f.width.resolve(srcSize.X)
+		height = int(math.Round(float64(width) * float64(f.aspect.Y) / float64(f.aspect.X)))
+	case f.height.set:
+		height = f.height.resolve(srcSize.Y)
+		width = int(math.Round(float64(height) * float64(f.aspect.X) / float64(f.aspect.Y)))
+	case srcSize.X*f.aspect.Y > srcSize.Y*f.aspect.X:
+		// No size at all: the largest region with the aspect ratio.
+		height = srcSize.Y
+		width = int(math.Round(float64(height) * float64(f.aspect.X) / float64(f.aspect.Y)))
+	default:
+		width = srcSize.X
+		height = int(math.Round(float64(width) * float64(f.aspect.Y) / float64(f.aspect.X)))
+	}
+
+	offset := anchorOffset(srcSize, image.Pt(width, height), f.anchor)
+	if f.x.set {
+		offset.X = f.x.resolve(srcSize.X)
+	}
+	if f.y.set {
+		offset.Y = f.y.resolve(srcSize.Y)
+	}
+	return image.Rectangle{Min: offset, Max: offset.Add(image.Pt(width, height))}
+}
+
+// validate reports an error when the region is empty or not entirely inside srcBounds.
+func (f cropRegionFilter) validate(srcBounds image.Rectangle) error {
+	size := srcBounds.Size()
+	rect := f.rect(size)
+	if rect.Empty() {
+		return fmt.Errorf("crop rectangle %dx%d is empty", rect.Dx(), rect.Dy())
+	}
+	if !rect.In(image.Rectangle{Max: size}) {
+		return fmt.Errorf("crop rectangle x=%d, y=%d, width=%d, height=%d is outside the %dx%d image",
+			rect.Min.X, rect.Min.Y, rect.Dx(), rect.Dy(), size.X, size.Y)
+	}
+	return nil
+}
+
+// Bounds returns the size of the cropped region, clipped to the source.
+func (f cropRegionFilter) Bounds(srcBounds image.Rectangle) image.Rectangle {
+	rect := f.rect(srcBounds.Size()).Add(srcBounds.Min).Intersect(srcBounds)
+	return image.Rect(0, 0, rect.Dx(), rect.Dy())
+}
+
+// Draw copies the region of src into dst.
+func (f cropRegionFilter) Draw(dst draw.Image, src image.Image, options *gift.Options) {
+	rect := f.rect(src.Bounds().Size()).Add(src.Bounds().Min).Intersect(src.Bounds())
+	g := gift.New(gift.Crop(rect))
+	if options != nil {
+		g.Options = *options
+	}
+	g.Draw(dst, src)
+}
+
+// boundsValidator is implemented by filters whose parameters can only be checked
+// against the dimensions of the image they are applied to.
+type boundsValidator interface {
+	validate(srcBounds image.Rectangle) error
+}
+
+// validateBounds checks filter against the bounds of the image it will be applied to,
+// if the filter supports it.
+func validateBounds(filter gift.Filter, srcBounds image.Rectangle) error {
+	if v, ok := filter.(boundsValidator); ok {
+		return v.validate(srcBounds)
+	}
+	return nil
+}
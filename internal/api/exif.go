@@ -0,0 +1,379 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"github.com/disintegration/gift"
+)
+
+// EXIF tags used by the service.
+const (
+	exifTagOrientation = 0x0112
+	exifTagExifIFD     = 0x8769
+	exifTagGPSIFD      = 0x8825
+)
+
+// exifTagNames names the IFD0 and Exif sub-IFD tags reported by /info.
+var exifTagNames = map[uint16]string{
+	0x010E: "ImageDescription",
+	0x010F: "Make",
+	0x0110: "Model",
+	0x0112: "Orientation",
+	0x011A: "XResolution",
+	0x011B: "YResolution",
+	0x0128: "ResolutionUnit",
+	0x0131: "Software",
+	0x0132: "DateTime",
+	0x013B: "Artist",
+	0x8298: "Copyright",
+	0x829A: "ExposureTime",
+	0x829D: "FNumber",
+	0x8822: "ExposureProgram",
+	0x8827: "ISOSpeedRatings",
+	0x9003: "DateTimeOriginal",
+	0x9004: "DateTimeDigitized",
+	0x9201: "ShutterSpeedValue",
+	0x9202: "ApertureValue",
+	0x9204: "ExposureBiasValue",
+	0x9207: "MeteringMode",
+	0x9209: "Flash",
+	0x920A: "FocalLength",
+	0xA001: "ColorSpace",
+	0xA002: "PixelXDimension",
+	0xA003: "PixelYDimension",
+	0xA405: "FocalLengthIn35mmFilm",
+	0xA433: "LensMake",
+	0xA434: "LensModel",
+}
+
+// gpsTagNames names the GPS sub-IFD tags reported by /info.
+var gpsTagNames = map[uint16]string{
+	0x0000: "GPSVersionID",
+	0x0001: "GPSLatitudeRef",
+	0x0002: "GPSLatitude",
+	0x0003: "GPSLongitudeRef",
+	0x0004: "GPSLongitude",
+	0x0005: "GPSAltitudeRef",
+	0x0006: "GPSAltitude",
+	0x0007: "GPSTimeStamp",
+	0x001D: "GPSDateStamp",
+}
+
+// exifHeader prefixes the TIFF payload of a JPEG APP1 EXIF segment.
+var exifHeader = []byte("Exif\x00\x00")
+
+// ifdEntry is a single raw entry of a TIFF image file directory.
+type ifdEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	// value holds the entry's data, either inline or read from its offset.
+	value []byte
+}
+
+// exifData is a parsed TIFF structure as found in an EXIF segment.
+type exifData struct {
+	tiff  []byte
+	order binary.ByteOrder
+	ifd0  []ifdEntry
+	// exif and gps are the Exif and GPS sub-IFDs referenced from IFD0, if any.
+	exif []ifdEntry
+	gps  []ifdEntry
+}
+
+// parseEXIF parses the TIFF header, the first IFD and the Exif and GPS sub-IFDs
+// of an EXIF payload. Broken sub-IFDs are skipped.
+func parseEXIF(tiff []byte) (*exifData, error) {
+	if len(tiff) < 8 {
+		return nil, errors.New("exif: truncated header")
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("exif: invalid byte order")
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return nil, errors.New("exif: invalid TIFF marker")
+	}
+
+	x := &exifData{tiff: tiff, order: order}
+	entries, err := x.readIFD(order.Uint32(tiff[4:]))
+	if err != nil {
+		return nil, err
+	}
+	x.ifd0 = entries
+
+	if entry, ok := findEntry(x.ifd0, exifTagExifIFD); ok {
+		if offset, ok := x.uintValue(entry); ok {
+			x.exif, _ = x.readIFD(offset)
+		}
+	}
+	if entry, ok := findEntry(x.ifd0, exifTagGPSIFD); ok {
+		if offset, ok := x.uintValue(entry); ok {
+			x.gps, _ = x.readIFD(offset)
+		}
+	}
+
+	return x, nil
+}
+
+// exifTypeSizes gives the size in bytes of a single value of each TIFF field type.
+var exifTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// readIFD reads the image file directory at offset.
+func (x *exifData) readIFD(offset uint32) ([]ifdEntry, error) {
+	if uint64(offset)+2 > uint64(len(x.tiff)) {
+		return nil, errors.New("exif: IFD offset out of range")
+	}
+
+	count := int(x.order.Uint16(x.tiff[offset:]))
+	start := int(offset) + 2
+	if start+count*12 > len(x.tiff) {
+		return nil, errors.New("exif: truncated IFD")
+	}
+
+	entries := make([]ifdEntry, 0, count)
+	for i := 0; i < count; i++ {
+		raw := x.tiff[start+i*12 : start+(i+1)*12]
+		entry := ifdEntry{
+			tag:   x.order.Uint16(raw[0:]),
+			typ:   x.order.Uint16(raw[2:]),
+			count: x.order.Uint32(raw[4:]),
+		}
+
+		size, ok := exifTypeSizes[entry.typ]
+		if !ok {
+			continue
+		}
+		total := uint64(size) * uint64(entry.count)
+		if total <= 4 {
+			entry.value = raw[8 : 8+total]
+		} else {
+			valueOffset := uint64(x.order.Uint32(raw[8:]))
+			if valueOffset+total > uint64(len(x.tiff)) {
+				continue
+			}
+			entry.value = x.tiff[valueOffset : valueOffset+total]
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// findEntry returns the entry with the given tag from entries.
+func findEntry(entries []ifdEntry, tag uint16) (ifdEntry, bool) {
+	for _, entry := range entries {
+		if entry.tag == tag {
+			return entry, true
+		}
+	}
+	return ifdEntry{}, false
+}
+
+// uintValue returns the first value of an integer entry.
+func (x *exifData) uintValue(entry ifdEntry) (uint32, bool) {
+	switch {
+	case entry.typ == 1 && len(entry.value) >= 1:
+		return uint32(entry.value[0]), true
+	case entry.typ == 3 && len(entry.value) >= 2:
+		return uint32(x.order.Uint16(entry.value)), true
+	case entry.typ == 4 && len(entry.value) >= 4:
+		return x.order.Uint32(entry.value), true
+	}
+	return 0, false
+}
+
+// value converts an entry to a JSON-friendly value: strings for ASCII, numbers for
+// integers and rationals, and slices when the entry holds more than one value.
+func (x *exifData) value(entry ifdEntry) any {
+	if entry.typ == 2 {
+		return strings.TrimRight(string(entry.value), "\x00 ")
+	}
+
+	size := exifTypeSizes[entry.typ]
+	var values []any
+	for i := uint32(0); i < entry.count && int((i+1)*size) <= len(entry.value); i++ {
+		raw := entry.value[i*size : (i+1)*size]
+		switch entry.typ {
+		case 1, 7:
+			values = append(values, raw[0])
+		case 6:
+			values = append(values, int8(raw[0]))
+		case 3:
+			values = append(values, x.order.Uint16(raw))
+		case 8:
+			values = append(values, int16(x.order.Uint16(raw)))
+		case 4:
+			values = append(values, x.order.Uint32(raw))
+		case 9:
+			values = append(values, int32(x.order.Uint32(raw)))
+		case 5, 10:
+			num, den := x.order.Uint32(raw), x.order.Uint32(raw[4:])
+			if den == 0 {
+				values = append(values, 0.0)
+			} else if entry.typ == 10 {
+				values = append(values, float64(int32(num))/float64(int32(den)))
+			} else {
+				values = append(values, float64(num)/float64(den))
+			}
+		default:
+			return nil
+		}
+	}
+
+	// Undefined data such as maker notes is not meaningful as a list of bytes.
+	if entry.typ == 7 && len(values) > 4 {
+		return nil
+	}
+	if len(values) == 1 {
+		return values[0]
+	}
+	return values
+}
+
+// fields returns the known tags of IFD0 and the Exif and GPS sub-IFDs keyed by name.
+func (x *exifData) fields() map[string]any {
+	fields := map[string]any{}
+	add := func(entries []ifdEntry, names map[uint16]string) {
+		for _, entry := range entries {
+			name, ok := names[entry.tag]
+			if !ok {
+				continue
+			}
+			if value := x.value(entry); value != nil {
+				fields[name] = value
+			}
+		}
+	}
+
+	add(x.ifd0, exifTagNames)
+	add(x.exif, exifTagNames)
+	add(x.gps, gpsTagNames)
+	return fields
+}
+
+// orientation returns the EXIF Orientation tag (1-8), or 1 if it is missing or invalid.
+func (x *exifData) orientation() int {
+	entry, ok := findEntry(x.ifd0, exifTagOrientation)
+	if !ok {
+		return 1
+	}
+	value, ok := x.uintValue(entry)
+	if !ok || value < 1 || value > 8 {
+		return 1
+	}
+	return int(value)
+}
+
+// rewriteEXIF returns a copy of an EXIF payload with the Orientation tag reset to 1
+// and/or the GPS sub-IFD removed. Removing GPS zeroes the GPS directory and its values
+// and drops the pointer entry from IFD0, so no location data survives in the copy.
+func rewriteEXIF(tiff []byte, resetOrientation, stripGPS bool) ([]byte, error) {
+	x, err := parseEXIF(tiff)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, len(tiff))
+	copy(out, tiff)
+	order := x.order
+
+	ifd0 := int(order.Uint32(out[4:]))
+	count := int(order.Uint16(out[ifd0:]))
+	start := ifd0 + 2
+
+	gpsIndex := -1
+	for i := 0; i < count; i++ {
+		entry := out[start+i*12 : start+(i+1)*12]
+		switch order.Uint16(entry) {
+		case exifTagOrientation:
+			if !resetOrientation {
+				break
+			}
+			// Write 1 in whichever integer type orientation() accepted the value as.
+			switch order.Uint16(entry[2:]) {
+			case 1:
+				entry[8] = 1
+			case 3:
+				order.PutUint16(entry[8:], 1)
+			case 4:
+				order.PutUint32(entry[8:], 1)
+			}
+		case exifTagGPSIFD:
+			gpsIndex = i
+		}
+	}
+
+	if !stripGPS || gpsIndex < 0 {
+		return out, nil
+	}
+
+	// Zero the GPS directory, including values stored outside it. The pointer may be
+	// stored as any integer type, so it is read as parseEXIF reads it.
+	pointer, _ := findEntry(x.ifd0, exifTagGPSIFD)
+	offset, ok := x.uintValue(pointer)
+	if !ok {
+		return nil, errors.New("exif: invalid GPS IFD pointer")
+	}
+	gpsOffset := int(offset)
+	if gpsOffset+2 <= len(out) {
+		gpsCount := int(order.Uint16(out[gpsOffset:]))
+		gpsEnd := min(gpsOffset+2+gpsCount*12+4, len(out))
+		for i := 0; i < gpsCount && gpsOffset+2+(i+1)*12 <= len(out); i++ {
+			entry := out[gpsOffset+2+i*12:]
+			size := uint64(exifTypeSizes[order.Uint16(entry[2:])]) * uint64(order.Uint32(entry[4:]))
+			if size > 4 {
+				valueOffset := uint64(order.Uint32(entry[8:]))
+				if valueOffset+size <= uint64(len(out)) {
+					clear(out[valueOffset : valueOffset+size])
+				}
+			}
+		}
+		clear(out[gpsOffset:gpsEnd])
+	}
+
+	// Drop the pointer entry by shifting the following entries and the next-IFD offset down.
+	entryStart := start + gpsIndex*12
+	tableEnd := start + count*12 + 4
+	if tableEnd > len(out) {
+		return nil, errors.New("exif: truncated IFD")
+	}
+	copy(out[entryStart:], out[entryStart+12:tableEnd])
+	clear(out[tableEnd-12 : tableEnd])
+	order.PutUint16(out[ifd0:], uint16(count-1))
+
+	return out, nil
+}
+
+// orientationFilter returns the gift filter that turns an image stored with the given
+// EXIF orientation upright, or nil for the normal orientation.
+func orientationFilter(orientation int) gift.Filter {
+	switch orientation {
+	case 2:
+		return gift.FlipHorizontal()
+	case 3:
+		return gift.Rotate180()
+	case 4:
+		return gift.FlipVertical()
+	case 5:
+		return gift.Transpose()
+	case 6:
+		return gift.Rotate270()
+	case 7:
+		return gift.Transverse()
+	case 8:
+		return gift.Rotate90()
+	}
+	return nil
+}
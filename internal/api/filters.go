@@ -0,0 +1,266 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/disintegration/gift"
+)
+
+// The filter builders below translate request parameters into gift filters.
+// They are shared by the single-purpose handlers and by the /process pipeline,
+// so both accept exactly the same parameter names and produce the same errors.
+
+// resizeFilter builds a resize filter from the `width` and `height` parameters.
+// Invalid or missing dimensions are treated as 0, and if both are 0 a default
+// width of 500 is used, preserving aspect ratio.
+//
+// Optional parameters:
+//   - `fit`: how both dimensions are honored — fill (default, exact stretch), cover,
+//     contain, inside or outside.
+//   - `gravity`: the anchor used by cover to crop and by contain to position the image.
+//   - `background`: the #RRGGBB or #RRGGBBAA padding color for contain (default transparent).
+//   - `withoutEnlargement`: when true, the image is never upscaled.
+//   - `filter`: the resampling filter — nearest, box, linear, cubic or lanczos (default).
+//   - `sharpen`: when true, a mild unsharp mask is applied after downscaling to counter
+//     the softening of resampling.
+//   - `crop`: with fit=cover, `auto` picks the cropped region from the image content
+//     (see smartCropFilter) instead of `gravity`.
+func resizeFilter(params url.Values) (gift.Filter, error) {
+	width, _ := strconv.Atoi(params.Get("width"))
+	height, _ := strconv.Atoi(params.Get("height"))
+	if width < 0 || height < 0 {
+		return nil, errors.New("invalid 'width' or 'height' parameter. Must not be negative")
+	}
+	if width > maxOutputDimension || height > maxOutputDimension {
+		return nil, fmt.Errorf("invalid 'width' or 'height' parameter. Must be at most %d", maxOutputDimension)
+	}
+
+	// If no dimensions are provided, apply a default.
+	if width == 0 && height == 0 {
+		width = 500
+	}
+
+	mode := params.Get("fit")
+	switch mode {
+	case "":
+		mode = fitFill
+	case fitFill, fitCover, fitContain, fitInside, fitOutside:
+	default:
+		return nil, errors.New("invalid 'fit' parameter. Supported: cover, contain, fill, inside, outside")
+	}
+
+	filter := params.Get("filter")
+	resampling, err := parseResampling(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	anchor, err := parseGravity(params.Get("gravity"))
+	if err != nil {
+		return nil, err
+	}
+
+	background, err := colorParam(params.Get("background"), color.Transparent)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'background' parameter: %v", err)
+	}
+
+	withoutEnlargement, err := boolParam(params, "withoutEnlargement", false)
+	if err != nil {
+		return nil, err
+	}
+
+	sharpen, err := boolParam(params, "sharpen", false)
+	if err != nil {
+		return nil, err
+	}
+
+	switch params.Get("crop") {
+	case "":
+	case "auto":
+		if mode != fitCover || width == 0 || height == 0 {
+			return nil, errors.New("'crop=auto' requires fit=cover with both 'width' and 'height'")
+		}
+		return smartCropFilter{
+			width:              width,
+			height:             height,
+			resampling:         resampling,
+			withoutEnlargement: withoutEnlargement,
+			sharpen:            sharpen,
+		}, nil
+	default:
+		return nil, errors.New("invalid 'crop' parameter. Supported: auto")
+	}
+
+	return fitFilter{
+		mode:               mode,
+		width:              width,
+		height:             height,
+		resampling:         resampling,
+		preShrink:          filter == "" || filter == "lanczos",
+		anchor:             anchor,
+		background:         background,
+		withoutEnlargement: withoutEnlargement,
+		sharpen:            sharpen,
+	}, nil
+}
+
+// cropFilter builds a crop filter from the `x`, `y`, `width` and `height` parameters.
+// Each may be an integer number of pixels or a percentage of the source dimension
+// (e.g. "10%").
+//
+// Optional parameters:
+//   - `gravity`: positions the region along any axis whose coordinate is omitted
+//     (default center), so that only `width` and `height` are needed.
+//   - `aspect`: a W:H ratio such as 16:9, replacing one of `width` or `height`, or both
+//     to crop the largest region with that ratio.
+//
+// The region must lie inside the image; this is checked with validateBounds once the
+// source dimensions are known.
+func cropFilter(params url.Values) (gift.Filter, error) {
+	var f cropRegionFilter
+	var err error
+	for _, p := range []struct {
+		name   string
+		length *cropLength
+	}{{"x", &f.x}, {"y", &f.y}, {"width", &f.width}, {"height", &f.height}} {
+		if *p.length, err = parseCropLength(p.name, params.Get(p.name)); err != nil {
+			return nil, err
+		}
+	}
+
+	if aspect := params.Get("aspect"); aspect != "" {
+		if f.width.set && f.height.set {
+			return nil, errors.New("'aspect' cannot be combined with both 'width' and 'height'")
+		}
+		if f.aspect, err = parseAspect(aspect); err != nil {
+			return nil, err
+		}
+	} else if !f.width.set || !f.height.set {
+		return nil, errors.New("missing crop size. Required: width and height, or aspect")
+	}
+
+	if f.anchor, err = parseGravity(params.Get("gravity")); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// rotateFilter builds a counter-clockwise rotation filter from the `angle` parameter,
+// which may be any number of degrees.
+//
+// Optional parameters:
+//   - `interpolation`: nearest, linear or cubic (default) for non-right angles.
+//   - `background`: #RRGGBB or #RRGGBBAA fill for the exposed corners (default transparent).
+//   - `expand`: when false, the original canvas size is kept and the rotated image is
+//     cropped around its center instead of growing to fit.
+//
+// Multiples of 90 degrees use gift's exact rotations.
+func rotateFilter(params url.Values) (gift.Filter, error) {
+	angle, err := strconv.ParseFloat(params.Get("angle"), 64)
+	if err != nil || math.IsNaN(angle) || math.IsInf(angle, 0) {
+		return nil, errors.New("invalid 'angle' parameter. Must be a number of degrees")
+	}
+
+	interpolation, err := parseInterpolation(params.Get("interpolation"))
+	if err != nil {
+		return nil, err
+	}
+
+	background, err := colorParam(params.Get("background"), color.Transparent)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'background' parameter: %v", err)
+	}
+
+	expand := true
+	if v := params.Get("expand"); v != "" {
+		expand, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.New("invalid 'expand' parameter. Must be true or false")
+		}
+	}
+
+	var filter gift.Filter
+	switch normalized := math.Mod(math.Mod(angle, 360)+360, 360); normalized {
+	case 90:
+		filter = gift.Rotate90()
+	case 180:
+		filter = gift.Rotate180()
+	case 270:
+		filter = gift.Rotate270()
+	default:
+		filter = gift.Rotate(float32(normalized), background, interpolation)
+	}
+
+	if !expand {
+		return fixedCanvasFilter{filter}, nil
+	}
+	return filter, nil
+}
+
+// fixedCanvasFilter wraps a filter so that its output keeps the source dimensions,
+// cropping the result around its center.
+type fixedCanvasFilter struct {
+	gift.Filter
+}
+
+// Bounds returns the source size, anchored at the origin like gift's own filters.
+func (f fixedCanvasFilter) Bounds(srcBounds image.Rectangle) image.Rectangle {
+	return image.Rect(0, 0, srcBounds.Dx(), srcBounds.Dy())
+}
+
+// Draw applies the wrapped filter and crops its output to the source size.
+func (f fixedCanvasFilter) Draw(dst draw.Image, src image.Image, options *gift.Options) {
+	g := gift.New(f.Filter, gift.CropToSize(src.Bounds().Dx(), src.Bounds().Dy(), gift.CenterAnchor))
+	if options != nil {
+		g.Options = *options
+	}
+	g.Draw(dst, src)
+}
+
+// flipFilter builds a flip filter from the `direction` parameter,
+// which must be "horizontal" or "vertical".
+func flipFilter(params url.Values) (gift.Filter, error) {
+	switch params.Get("direction") {
+	case "horizontal":
+		return gift.FlipHorizontal(), nil
+	case "vertical":
+		return gift.FlipVertical(), nil
+	default:
+		return nil, errors.New("invalid or missing 'direction' parameter. Supported: horizontal, vertical")
+	}
+}
+
+// applyFilters runs src through a single gift chain made of the given filters
+// and returns the result.
+func applyFilters(src image.Image, filters ...gift.Filter) *image.RGBA {
+	g := gift.New(filters...)
+	dst := image.NewRGBA(g.Bounds(src.Bounds()))
+	g.Draw(dst, src)
+	return dst
+}
+
+// transformImage applies filters to src and returns the result in the same format as src,
+// carrying over its metadata.
+// Animations are processed frame by frame when they are going to be written as GIF;
+// for any other output format only the first frame is processed.
+func transformImage(src *decodedImage, outFormat string, filters ...gift.Filter) *decodedImage {
+	defer observeStage(src.ctx, "transform", time.Now())
+	dst := &decodedImage{format: src.format, meta: src.meta, autorotated: src.autorotated, ctx: src.ctx}
+	if src.anim != nil && outFormat == "gif" {
+		dst.anim = applyFiltersToGIF(src.anim, filters...)
+		dst.image = dst.anim.Image[0]
+	} else {
+		dst.image = applyFilters(src.image, filters...)
+	}
+	return dst
+}
@@ -2,14 +2,11 @@ package api
 
 import (
 	"fmt"
-	"image"
-	"image/jpeg"
-	"image/png" // Import for PNG decoding side-effects
-	"log"
+	_ "image/png" // Import for PNG decoding side-effects
 	"net/http"
 	"strconv"
 
-	"github.com/disintegration/gift"
+	"go-image-processing-service/internal/logging"
 )
 
 // HealthCheckHandler responds with a simple "OK" message to indicate the service is running.
@@ -22,22 +19,35 @@ func HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
 // ResizeHandler processes an image uploaded via a multipart form and resizes it.
 //
 // It expects a POST request with a form field named "image" containing the image file.
-// The handler supports decoding of JPEG and PNG image formats.
+// The handler supports decoding of JPEG, PNG, WebP and GIF image formats.
 //
 // Optional query parameters `width` and `height` (integers) can be provided to specify
 // the desired dimensions. If a dimension is not provided or is invalid, it is treated as 0.
 // - If both width and height are 0, a default width of 500 is used, preserving aspect ratio.
 // - If one dimension is 0, it's calculated to preserve the original aspect ratio.
 //
-// Upon successful processing, it returns the new image encoded as a JPEG.
+// When both dimensions are given, `fit` decides how they are honored: fill (default) stretches
+// to the exact size, cover crops the overflow, contain pads with `background`, inside fits within
+// the box and outside covers it without cropping. `gravity` positions the image for cover and
+// contain, and `withoutEnlargement=true` prevents upscaling. `filter` selects the resampling
+// filter (nearest, box, linear, cubic or lanczos, the default). With fit=cover, `crop=auto`
+// chooses the region to keep from the image content, reported in the X-Crop-Rect header.
+// `sharpen=true` applies a mild unsharp mask after downscaling to counter resampling blur.
+// Requests whose output would exceed the configured pixel limits are rejected with 413.
+//
+// Upon successful processing, it returns the new image in the format chosen by outputFormat:
+// the source format by default, overridable with a `format` query parameter or the Accept header.
+// Optional `quality` and `lossless` parameters tune the encoder, and `metadata` (keep, strip,
+// strip-gps) selects the source metadata copied into the output. Animated GIFs are resized
+// frame by frame when returned as GIF.
 func ResizeHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		http.Error(w, "Failed to parse multipart form", http.StatusBadRequest)
+	if err := r.ParseMultipartForm(settings.MaxUploadBytes); err != nil {
+		httpError(w, fmt.Errorf("Failed to parse multipart form: %w", err), http.StatusBadRequest)
 		return
 	}
 
@@ -48,7 +58,7 @@ func ResizeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	log.Printf("Received file: %s, size: %d bytes, content-type: %s", header.Filename, header.Size, header.Header.Get("Content-Type"))
+	logging.AddFields(r.Context(), "filename", header.Filename, "upload_bytes", header.Size, "upload_content_type", header.Header.Get("Content-Type"))
 
 	_, err = file.Seek(0, 0)
 	if err != nil {
@@ -56,49 +66,58 @@ func ResizeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	src, format, err := image.Decode(file)
+	src, err := decodeImage(file, decodeOptionsFromRequest(r))
 	if err != nil {
-		log.Printf("Error decoding image: %v", err)
-		http.Error(w, fmt.Sprintf("Could not decode image: %v", err), http.StatusBadRequest)
+		logging.FromContext(r.Context()).Warn("Could not decode image", "error", err)
+		httpError(w, fmt.Errorf("Could not decode image: %w", err), http.StatusBadRequest)
 		return
 	}
-	log.Printf("Successfully decoded image, format: %s", format)
-
-	// Parse width and height from query parameters.
-	width, _ := strconv.Atoi(r.URL.Query().Get("width"))
-	height, _ := strconv.Atoi(r.URL.Query().Get("height"))
+	logging.FromContext(r.Context()).Debug("Resizing", "width", r.URL.Query().Get("width"), "height", r.URL.Query().Get("height"))
 
-	// If no dimensions are provided, apply a default.
-	if width == 0 && height == 0 {
-		width = 500
+	filter, err := resizeFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkOutput(src.image.Bounds(), src.frames(), filter); err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
 	}
 
-	log.Printf("Resizing to width: %d, height: %d", width, height)
+	format, err := outputFormat(r, src)
+	if err != nil {
+		http.Error(w, err.Error(), outputFormatStatus(err))
+		return
+	}
+	w.Header().Add("Vary", "Accept")
 
-	g := gift.New(
-		gift.Resize(width, height, gift.LanczosResampling),
-	)
+	if smartCrop, ok := filter.(smartCropFilter); ok {
+		smartCrop = smartCrop.locate(src.image)
+		w.Header().Set(smartCropHeader, formatRect(smartCrop.rect))
+		logging.AddFields(r.Context(), "crop_rect", formatRect(smartCrop.rect))
+		filter = smartCrop
+	}
 
-	dst := image.NewRGBA(g.Bounds(src.Bounds()))
-	g.Draw(dst, src)
+	dst := transformImage(src, format, filter)
 
-	w.Header().Set("Content-Type", "image/jpeg")
-	err = jpeg.Encode(w, dst, nil)
+	err = writeImage(w, dst, format, encodeOptionsFromParams(r.URL.Query()))
 	if err != nil {
-		log.Printf("Error encoding resized image: %v", err)
+		logging.FromContext(r.Context()).Error("Could not encode resized image", "error", err)
 		http.Error(w, "Could not encode resized image", http.StatusInternalServerError)
 		return
 	}
-	log.Println("Successfully resized and sent image.")
 }
 
 // CompressHandler processes an image uploaded via a multipart form and adjusts its JPEG quality.
 //
 // It expects a POST request with a form field named "image" containing the image file.
-// The handler supports decoding of JPEG and PNG image formats.
+// The handler supports decoding of JPEG, PNG, WebP and GIF image formats.
 //
 // An optional query parameter `quality` (integer 1-100) can be provided.
-// If the quality is not provided or is invalid, a default quality of 75 is used.
+// If the quality is not provided or is invalid, the configured default quality (75 unless
+// changed, see Settings) is used.
+// An optional `metadata` parameter (keep, strip, strip-gps) controls which EXIF, ICC
+// and XMP metadata is copied from the source; it defaults to strip.
 //
 // The handler always returns a JPEG image.
 func CompressHandler(w http.ResponseWriter, r *http.Request) {
@@ -107,8 +126,8 @@ func CompressHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		http.Error(w, "Failed to parse multipart form", http.StatusBadRequest)
+	if err := r.ParseMultipartForm(settings.MaxUploadBytes); err != nil {
+		httpError(w, fmt.Errorf("Failed to parse multipart form: %w", err), http.StatusBadRequest)
 		return
 	}
 
@@ -125,27 +144,27 @@ func CompressHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	src, _, err := image.Decode(file)
+	src, err := decodeImage(file, decodeOptionsFromRequest(r))
 	if err != nil {
-		log.Printf("Error decoding image: %v", err)
-		http.Error(w, fmt.Sprintf("Could not decode image: %v", err), http.StatusBadRequest)
+		logging.FromContext(r.Context()).Warn("Could not decode image", "error", err)
+		httpError(w, fmt.Errorf("Could not decode image: %w", err), http.StatusBadRequest)
 		return
 	}
 
 	// Parse quality from query parameter.
 	quality, err := strconv.Atoi(r.URL.Query().Get("quality"))
 	if err != nil || quality < 1 || quality > 100 {
-		quality = 75 // Default quality
+		quality = settings.DefaultJPEGQuality
 	}
 
-	log.Printf("Encoding with JPEG quality: %d", quality)
+	logging.FromContext(r.Context()).Debug("Compressing", "quality", quality)
 
-	opts := &jpeg.Options{Quality: quality}
+	opts := encodeOptionsFromParams(r.URL.Query())
+	opts.quality = quality
 
-	w.Header().Set("Content-Type", "image/jpeg")
-	err = jpeg.Encode(w, src, opts)
+	err = writeImage(w, src, "jpeg", opts)
 	if err != nil {
-		log.Printf("Error encoding compressed image: %v", err)
+		logging.FromContext(r.Context()).Error("Could not encode compressed image", "error", err)
 		http.Error(w, "Could not encode compressed image", http.StatusInternalServerError)
 		return
 	}
@@ -154,7 +173,15 @@ func CompressHandler(w http.ResponseWriter, r *http.Request) {
 // ConvertHandler processes an image and converts it to a different format.
 //
 // It expects a POST request with a form field named "image" containing the image file.
-// A required query parameter `format` must be provided, which can be "jpeg" or "png".
+// A required query parameter `format` must be provided, which can be "jpeg", "png", "webp" or "gif".
+// Converting an animated GIF to GIF keeps every frame; other formats receive the first frame.
+// An optional `quality` (1-100) applies to JPEG output. WebP is always written as
+// lossless VP8L, since there is no pure Go lossy WebP encoder. With `lossless=false` the
+// colors are first quantized according to `quality` (default 75), like libwebp's
+// near-lossless mode. This usually makes photos smaller, but the result is not a lossy
+// (VP8) WebP and can be larger than one.
+// An optional `metadata` parameter (keep, strip, strip-gps) selects the source metadata
+// copied into the output; GIF output never carries metadata.
 //
 // Upon successful processing, it returns the new image encoded in the specified format
 // with the corresponding Content-Type header.
@@ -164,8 +191,8 @@ func ConvertHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		http.Error(w, "Failed to parse multipart form", http.StatusBadRequest)
+	if err := r.ParseMultipartForm(settings.MaxUploadBytes); err != nil {
+		httpError(w, fmt.Errorf("Failed to parse multipart form: %w", err), http.StatusBadRequest)
 		return
 	}
 
@@ -182,30 +209,24 @@ func ConvertHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	src, _, err := image.Decode(file)
+	src, err := decodeImage(file, decodeOptionsFromRequest(r))
 	if err != nil {
-		log.Printf("Error decoding image: %v", err)
-		http.Error(w, fmt.Sprintf("Could not decode image: %v", err), http.StatusBadRequest)
+		logging.FromContext(r.Context()).Warn("Could not decode image", "error", err)
+		httpError(w, fmt.Errorf("Could not decode image: %w", err), http.StatusBadRequest)
 		return
 	}
 
 	// Get target format from query parameter
 	format := r.URL.Query().Get("format")
 
-	switch format {
-	case "jpeg", "jpg":
-		w.Header().Set("Content-Type", "image/jpeg")
-		err = jpeg.Encode(w, src, nil) // Use default quality
-	case "png":
-		w.Header().Set("Content-Type", "image/png")
-		err = png.Encode(w, src)
-	default:
-		http.Error(w, `Invalid or missing 'format' parameter. Supported formats: jpeg, png`, http.StatusBadRequest)
+	if !isSupportedFormat(format) {
+		http.Error(w, `Invalid or missing 'format' parameter. Supported formats: jpeg, png, webp, gif`, http.StatusBadRequest)
 		return
 	}
 
+	err = writeImage(w, src, format, encodeOptionsFromParams(r.URL.Query()))
 	if err != nil {
-		log.Printf("Error encoding image to %s: %v", format, err)
+		logging.FromContext(r.Context()).Error("Could not encode image", "format", format, "error", err)
 		http.Error(w, "Could not encode image", http.StatusInternalServerError)
 	}
 }
@@ -214,74 +235,72 @@ func ConvertHandler(w http.ResponseWriter, r *http.Request) {
 //
 // It expects a POST request with an "image" form field.
 // A required `direction` query parameter must be "horizontal" or "vertical".
+// The result keeps the source format unless overridden (see ResizeHandler).
+// Animated GIFs are flipped frame by frame.
 func FlipHandler(w http.ResponseWriter, r *http.Request) {
 	// Basic boilerplate for decoding an image
 	src, err := decodeImageFromRequest(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		httpError(w, err, http.StatusBadRequest)
 		return
 	}
 
-	direction := r.URL.Query().Get("direction")
+	filter, err := flipFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	var filter gift.Filter
-	switch direction {
-	case "horizontal":
-		filter = gift.FlipHorizontal()
-	case "vertical":
-		filter = gift.FlipVertical()
-	default:
-		http.Error(w, "Invalid or missing 'direction' parameter. Supported: horizontal, vertical", http.StatusBadRequest)
+	format, err := outputFormat(r, src)
+	if err != nil {
+		http.Error(w, err.Error(), outputFormatStatus(err))
 		return
 	}
+	w.Header().Add("Vary", "Accept")
 
-	g := gift.New(filter)
-	dst := image.NewRGBA(g.Bounds(src.Bounds()))
-	g.Draw(dst, src)
+	dst := transformImage(src, format, filter)
 
-	// Encode and send back as JPEG
-	w.Header().Set("Content-Type", "image/jpeg")
-	if err := jpeg.Encode(w, dst, nil); err != nil {
+	// Encode and send back in the negotiated format
+	if err := writeImage(w, dst, format, encodeOptionsFromParams(r.URL.Query())); err != nil {
 		http.Error(w, "Could not encode flipped image", http.StatusInternalServerError)
 	}
 }
 
-// RotateHandler processes an image and rotates it by a 90-degree increment.
+// RotateHandler processes an image and rotates it counter-clockwise by any angle.
 //
 // It expects a POST request with an "image" form field.
-// A required `angle` query parameter must be 90, 180, or 270.
+// A required `angle` query parameter gives the angle in degrees, e.g. 90 or 12.5.
+// Optional `interpolation` (nearest, linear, cubic), `background` (#RRGGBBAA) and
+// `expand` (default true) parameters control how non-right angles are rendered.
+// The result keeps the source format unless overridden (see ResizeHandler).
+// Animated GIFs are rotated frame by frame.
 func RotateHandler(w http.ResponseWriter, r *http.Request) {
 	src, err := decodeImageFromRequest(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		httpError(w, err, http.StatusBadRequest)
 		return
 	}
 
-	angle, err := strconv.Atoi(r.URL.Query().Get("angle"))
+	filter, err := rotateFilter(r.URL.Query())
 	if err != nil {
-		http.Error(w, "Invalid 'angle' parameter. Must be an integer.", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkOutput(src.image.Bounds(), src.frames(), filter); err != nil {
+		httpError(w, err, http.StatusBadRequest)
 		return
 	}
 
-	var filter gift.Filter
-	switch angle {
-	case 90:
-		filter = gift.Rotate90()
-	case 180:
-		filter = gift.Rotate180()
-	case 270:
-		filter = gift.Rotate270()
-	default:
-		http.Error(w, "Invalid 'angle' parameter. Supported: 90, 180, 270", http.StatusBadRequest)
+	format, err := outputFormat(r, src)
+	if err != nil {
+		http.Error(w, err.Error(), outputFormatStatus(err))
 		return
 	}
+	w.Header().Add("Vary", "Accept")
 
-	g := gift.New(filter)
-	dst := image.NewRGBA(g.Bounds(src.Bounds()))
-	g.Draw(dst, src)
+	dst := transformImage(src, format, filter)
 
-	w.Header().Set("Content-Type", "image/jpeg")
-	if err := jpeg.Encode(w, dst, nil); err != nil {
+	if err := writeImage(w, dst, format, encodeOptionsFromParams(r.URL.Query())); err != nil {
 		http.Error(w, "Could not encode rotated image", http.StatusInternalServerError)
 	}
 }
@@ -289,59 +308,55 @@ func RotateHandler(w http.ResponseWriter, r *http.Request) {
 // CropHandler processes an image and crops it to a specified rectangle.
 //
 // It expects a POST request with an "image" form field.
-// Four required integer query parameters must be provided: `x`, `y`, `width`, `height`.
+// The region is given by the `x`, `y`, `width` and `height` query parameters, in pixels or
+// as percentages of the image size (e.g. `x=10%`). Omitted coordinates are derived from
+// `gravity` (default center), and `aspect` (e.g. 16:9) can stand in for either size.
+// A region that does not lie entirely inside the image is rejected with a 400.
+// The result keeps the source format unless overridden (see ResizeHandler).
+// Animated GIFs are cropped frame by frame.
 func CropHandler(w http.ResponseWriter, r *http.Request) {
 	src, err := decodeImageFromRequest(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		httpError(w, err, http.StatusBadRequest)
 		return
 	}
 
-	// Parse all four crop parameters.
-	xStr := r.URL.Query().Get("x")
-	yStr := r.URL.Query().Get("y")
-	widthStr := r.URL.Query().Get("width")
-	heightStr := r.URL.Query().Get("height")
-
-	if xStr == "" || yStr == "" || widthStr == "" || heightStr == "" {
-		http.Error(w, "Missing one or more crop parameters. Required: x, y, width, height", http.StatusBadRequest)
+	filter, err := cropFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	x, errX := strconv.Atoi(xStr)
-	y, errY := strconv.Atoi(yStr)
-	width, errWidth := strconv.Atoi(widthStr)
-	height, errHeight := strconv.Atoi(heightStr)
-
-	if errX != nil || errY != nil || errWidth != nil || errHeight != nil {
-		http.Error(w, "Invalid crop parameters. All must be integers.", http.StatusBadRequest)
+	if err := validateBounds(filter, src.image.Bounds()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Cropping with rect: x=%d, y=%d, width=%d, height=%d", x, y, width, height)
+	logging.FromContext(r.Context()).Debug("Cropping", "x", r.URL.Query().Get("x"), "y", r.URL.Query().Get("y"),
+		"width", r.URL.Query().Get("width"), "height", r.URL.Query().Get("height"))
 
-	g := gift.New(
-		gift.Crop(image.Rect(x, y, x+width, y+height)),
-	)
+	format, err := outputFormat(r, src)
+	if err != nil {
+		http.Error(w, err.Error(), outputFormatStatus(err))
+		return
+	}
+	w.Header().Add("Vary", "Accept")
 
-	dst := image.NewRGBA(g.Bounds(src.Bounds()))
-	g.Draw(dst, src)
+	dst := transformImage(src, format, filter)
 
-	w.Header().Set("Content-Type", "image/jpeg")
-	if err := jpeg.Encode(w, dst, nil); err != nil {
+	if err := writeImage(w, dst, format, encodeOptionsFromParams(r.URL.Query())); err != nil {
 		http.Error(w, "Could not encode cropped image", http.StatusInternalServerError)
 	}
 }
 
 // decodeImageFromRequest is a helper function to reduce boilerplate in handlers.
 // It handles the request parsing, file seeking, and decoding.
-func decodeImageFromRequest(r *http.Request) (image.Image, error) {
+func decodeImageFromRequest(r *http.Request) (*decodedImage, error) {
 	if r.Method != http.MethodPost {
 		return nil, fmt.Errorf("only POST method is allowed")
 	}
 
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		return nil, fmt.Errorf("failed to parse multipart form")
+	if err := r.ParseMultipartForm(settings.MaxUploadBytes); err != nil {
+		return nil, fmt.Errorf("failed to parse multipart form: %w", err)
 	}
 
 	file, _, err := r.FormFile("image")
@@ -355,9 +370,9 @@ func decodeImageFromRequest(r *http.Request) (image.Image, error) {
 		return nil, fmt.Errorf("could not rewind file")
 	}
 
-	src, _, err := image.Decode(file)
+	src, err := decodeImage(file, decodeOptionsFromRequest(r))
 	if err != nil {
-		return nil, fmt.Errorf("could not decode image: %v", err)
+		return nil, fmt.Errorf("could not decode image: %w", err)
 	}
 
 	return src, nil
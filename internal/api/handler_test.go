@@ -2,13 +2,25 @@ package api_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
 	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
 	"image/png"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/HugoSmits86/nativewebp"
 
 	"go-image-processing-service/internal/api"
 )
@@ -21,6 +33,139 @@ func createDummyImage() (*bytes.Buffer, error) {
 	return buf, err
 }
 
+// createDummyWideImage generates a 20x10 PNG image in memory for testing aspect-ratio handling.
+func createDummyWideImage() (*bytes.Buffer, error) {
+	img := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	buf := new(bytes.Buffer)
+	err := png.Encode(buf, img)
+	return buf, err
+}
+
+// dummyImage returns the 10x10 PNG of createDummyImage.
+func dummyImage() *bytes.Buffer {
+	buf, _ := createDummyImage()
+	return buf
+}
+
+// createPNGHeader generates a PNG holding only a header that declares a width x height
+// image, as a decompression bomb would.
+func createPNGHeader(width, height uint32) *bytes.Buffer {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12], ihdr[13] = 8, 6 // 8-bit RGBA
+
+	buf := bytes.NewBufferString("\x89PNG\r\n\x1a\n")
+	binary.Write(buf, binary.BigEndian, uint32(len(ihdr)-4))
+	buf.Write(ihdr)
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(ihdr))
+	return buf
+}
+
+// createDummyAnimatedGIF generates a 3-frame 10x10 animated GIF in memory for testing.
+func createDummyAnimatedGIF() (*bytes.Buffer, error) {
+	palette := color.Palette{color.Black, color.White, color.RGBA{R: 255, A: 255}}
+	anim := &gif.GIF{LoopCount: 2}
+	for i := 0; i < 3; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 10, 10), palette)
+		frame.SetColorIndex(i, i, uint8(i))
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10*(i+1))
+		anim.Disposal = append(anim.Disposal, gif.DisposalNone)
+	}
+	buf := new(bytes.Buffer)
+	err := gif.EncodeAll(buf, anim)
+	return buf, err
+}
+
+// createManyFrameGIF generates an animated GIF of the given number of identical
+// width x height frames. Identical frames compress well, so the file stays small while
+// decoding it allocates every frame.
+func createManyFrameGIF(width, height, frames int) *bytes.Buffer {
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, width, height), palette))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	buf := new(bytes.Buffer)
+	gif.EncodeAll(buf, anim)
+	return buf
+}
+
+// createDummyJPEGWithOrientation generates a 10x6 JPEG carrying an EXIF Orientation tag.
+func createDummyJPEGWithOrientation(orientation uint16) (*bytes.Buffer, error) {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 6))
+	encoded := new(bytes.Buffer)
+	if err := jpeg.Encode(encoded, img, nil); err != nil {
+		return nil, err
+	}
+
+	// Big-endian TIFF header followed by an IFD with a single SHORT Orientation entry.
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(tiff[18:], orientation)
+
+	return insertJPEGSegment(encoded.Bytes(), 0xE1, append([]byte("Exif\x00\x00"), tiff...)), nil
+}
+
+// createDummyJPEGWithMetadata generates a 10x6 JPEG carrying EXIF (Orientation 6 and a
+// GPS block), an XMP packet with GPS properties and a minimal ICC profile. The GPS IFD
+// pointer is stored as a LONG, or as a SHORT when shortGPSPointer is set; Orientation
+// is stored as a SHORT, or as a LONG when longOrientation is set.
+func createDummyJPEGWithMetadata(shortGPSPointer, longOrientation bool) (*bytes.Buffer, error) {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 6))
+	encoded := new(bytes.Buffer)
+	if err := jpeg.Encode(encoded, img, nil); err != nil {
+		return nil, err
+	}
+
+	// IFD0 at offset 8 holds Orientation and the GPS IFD pointer; the GPS IFD at offset 38
+	// holds GPSLatitudeRef = "N".
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8,
+		0, 2,
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, 6, 0, 0,
+		0x88, 0x25, 0, 4, 0, 0, 0, 1, 0, 0, 0, 38,
+		0, 0, 0, 0,
+		0, 1,
+		0x00, 0x01, 0, 2, 0, 0, 0, 2, 'N', 0, 0, 0,
+		0, 0, 0, 0,
+	}
+	if shortGPSPointer {
+		copy(tiff[22:], []byte{0x88, 0x25, 0, 3, 0, 0, 0, 1, 0, 38, 0, 0})
+	}
+	if longOrientation {
+		copy(tiff[10:], []byte{0x01, 0x12, 0, 4, 0, 0, 0, 1, 0, 0, 0, 6})
+	}
+
+	icc := make([]byte, 132)
+	binary.BigEndian.PutUint32(icc, uint32(len(icc)))
+	icc[8] = 2
+	copy(icc[12:], "mntrRGB XYZ ")
+
+	xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:exif="http://ns.adobe.com/exif/1.0/" exif:GPSLatitude="52,22.5N">` +
+		`<dc:rights>(c) Example</dc:rights><exif:GPSLongitude>4,53.7E</exif:GPSLongitude></rdf:Description>` +
+		`</rdf:RDF></x:xmpmeta>`
+
+	data := encoded.Bytes()
+	data = insertJPEGSegment(data, 0xE2, append([]byte("ICC_PROFILE\x00\x01\x01"), icc...)).Bytes()
+	data = insertJPEGSegment(data, 0xE1, append([]byte("http://ns.adobe.com/xap/1.0/\x00"), xmp...)).Bytes()
+	return insertJPEGSegment(data, 0xE1, append([]byte("Exif\x00\x00"), tiff...)), nil
+}
+
+// insertJPEGSegment returns a copy of a JPEG with a marker segment inserted right after SOI.
+func insertJPEGSegment(data []byte, marker byte, payload []byte) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	buf.Write(data[:2]) // SOI
+	buf.Write([]byte{0xFF, marker})
+	binary.Write(buf, binary.BigEndian, uint16(len(payload)+2))
+	buf.Write(payload)
+	buf.Write(data[2:])
+	return buf
+}
+
 // createImageUploadRequest creates a new multipart/form-data HTTP request with a dummy image.
 func createImageUploadRequest(url string, body io.Reader, contentType string) *http.Request {
 	req := httptest.NewRequest(http.MethodPost, url, body)
@@ -229,6 +374,48 @@ func TestConvertHandler(t *testing.T) {
 			expectedStatusCode: http.StatusOK,
 			expectedMimeType:   "image/png",
 		},
+		{
+			name: "Success - Convert to Lossless WebP",
+			requestSetup: func() *http.Request {
+				imgBuf, _ := createDummyImage()
+				body := new(bytes.Buffer)
+				writer := multipart.NewWriter(body)
+				part, _ := writer.CreateFormFile("image", "test.png")
+				part.Write(imgBuf.Bytes())
+				writer.Close()
+				return createImageUploadRequest("/convert?format=webp", body, writer.FormDataContentType())
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedMimeType:   "image/webp",
+		},
+		{
+			name: "Success - Convert to Lossy WebP",
+			requestSetup: func() *http.Request {
+				imgBuf, _ := createDummyImage()
+				body := new(bytes.Buffer)
+				writer := multipart.NewWriter(body)
+				part, _ := writer.CreateFormFile("image", "test.png")
+				part.Write(imgBuf.Bytes())
+				writer.Close()
+				return createImageUploadRequest("/convert?format=webp&lossless=false&quality=40", body, writer.FormDataContentType())
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedMimeType:   "image/webp",
+		},
+		{
+			name: "Success - Convert to GIF",
+			requestSetup: func() *http.Request {
+				imgBuf, _ := createDummyImage()
+				body := new(bytes.Buffer)
+				writer := multipart.NewWriter(body)
+				part, _ := writer.CreateFormFile("image", "test.png")
+				part.Write(imgBuf.Bytes())
+				writer.Close()
+				return createImageUploadRequest("/convert?format=gif", body, writer.FormDataContentType())
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedMimeType:   "image/gif",
+		},
 		{
 			name: "Failure - Missing Format",
 			requestSetup: func() *http.Request {
@@ -251,7 +438,7 @@ func TestConvertHandler(t *testing.T) {
 				part, _ := writer.CreateFormFile("image", "test.png")
 				part.Write(imgBuf.Bytes())
 				writer.Close()
-				return createImageUploadRequest("/convert?format=gif", body, writer.FormDataContentType())
+				return createImageUploadRequest("/convert?format=bmp", body, writer.FormDataContentType())
 			},
 			expectedStatusCode: http.StatusBadRequest,
 		},
@@ -320,8 +507,15 @@ func TestRotateHandler(t *testing.T) {
 	}{
 		{"Success - 90 degrees", "/rotate?angle=90", http.StatusOK},
 		{"Success - 180 degrees", "/rotate?angle=180", http.StatusOK},
+		{"Success - Arbitrary Angle", "/rotate?angle=12.5", http.StatusOK},
+		{"Success - Negative Angle With Options", "/rotate?angle=-30&interpolation=nearest&background=%23FF000080", http.StatusOK},
+		{"Success - Fixed Canvas", "/rotate?angle=45&expand=false", http.StatusOK},
 		{"Failure - Missing Angle", "/rotate", http.StatusBadRequest},
-		{"Failure - Invalid Angle", "/rotate?angle=45", http.StatusBadRequest},
+		{"Failure - Invalid Angle", "/rotate?angle=ninety", http.StatusBadRequest},
+		{"Failure - Non-Finite Angle", "/rotate?angle=NaN", http.StatusBadRequest},
+		{"Failure - Invalid Background", "/rotate?angle=45&background=red", http.StatusBadRequest},
+		{"Failure - Invalid Interpolation", "/rotate?angle=45&interpolation=bicubic", http.StatusBadRequest},
+		{"Failure - Invalid Expand", "/rotate?angle=45&expand=maybe", http.StatusBadRequest},
 	}
 
 	for _, tc := range testCases {
@@ -405,3 +599,1392 @@ func TestCropHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestProcessHandler(t *testing.T) {
+	testCases := []struct {
+		name               string
+		url                string
+		expectedStatusCode int
+		expectedMimeType   string
+		expectedWidth      int
+		expectedHeight     int
+	}{
+		{
+			name:               "Success - Compact Syntax",
+			url:                "/process?ops=crop:0,0,8,4|resize:4x0|rotate:90|format:png",
+			expectedStatusCode: http.StatusOK,
+			expectedMimeType:   "image/png",
+			expectedWidth:      2,
+			expectedHeight:     4,
+		},
+		{
+			name:               "Success - Named Arguments",
+			url:                "/process?ops=resize:width=6,height=3|flip:horizontal",
+			expectedStatusCode: http.StatusOK,
+			expectedMimeType:   "image/png",
+			expectedWidth:      6,
+			expectedHeight:     3,
+		},
+		{
+			name:               "Success - JSON Syntax",
+			url:                `/process?ops=[{"op":"crop","x":2,"y":2,"width":5,"height":5},{"op":"format","format":"png"}]`,
+			expectedStatusCode: http.StatusOK,
+			expectedMimeType:   "image/png",
+			expectedWidth:      5,
+			expectedHeight:     5,
+		},
+		{
+			// A single named argument containing "x" is not a WIDTHxHEIGHT pair.
+			name:               "Success - Single Named Resize Argument",
+			url:                "/process?ops=resize:filter=box",
+			expectedStatusCode: http.StatusOK,
+			expectedMimeType:   "image/png",
+			expectedWidth:      500,
+			expectedHeight:     500,
+		},
+		{"Failure - Missing Ops", "/process", http.StatusBadRequest, "", 0, 0},
+		{"Failure - Unknown Operation", "/process?ops=resize:5x5|explode", http.StatusBadRequest, "", 0, 0},
+		{"Failure - Invalid Step Parameter", "/process?ops=rotate:sideways", http.StatusBadRequest, "", 0, 0},
+		{"Failure - Invalid Format", "/process?ops=format:bmp", http.StatusBadRequest, "", 0, 0},
+		{"Failure - Too Many Arguments", "/process?ops=rotate:90,180", http.StatusBadRequest, "", 0, 0},
+		{"Failure - Malformed JSON", "/process?ops=[{", http.StatusBadRequest, "", 0, 0},
+		{"Failure - Crop Outside Resized Image", "/process?ops=resize:4x4|crop:0,0,6,6", http.StatusBadRequest, "", 0, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			imgBuf, _ := createDummyImage()
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "test.png")
+			part.Write(imgBuf.Bytes())
+			writer.Close()
+			req := createImageUploadRequest(tc.url, body, writer.FormDataContentType())
+
+			recorder := httptest.NewRecorder()
+			api.ProcessHandler(recorder, req)
+
+			if recorder.Code != tc.expectedStatusCode {
+				t.Fatalf("Expected status code %d, got %d: %s", tc.expectedStatusCode, recorder.Code, recorder.Body.String())
+			}
+
+			if recorder.Code != http.StatusOK {
+				return
+			}
+
+			if contentType := recorder.Header().Get("Content-Type"); contentType != tc.expectedMimeType {
+				t.Errorf("Expected Content-Type %s, got %s", tc.expectedMimeType, contentType)
+			}
+
+			img, _, err := image.Decode(recorder.Body)
+			if err != nil {
+				t.Fatalf("Failed to decode response image: %v", err)
+			}
+			if img.Bounds().Dx() != tc.expectedWidth || img.Bounds().Dy() != tc.expectedHeight {
+				t.Errorf("Expected image dimensions %dx%d, got %dx%d", tc.expectedWidth, tc.expectedHeight, img.Bounds().Dx(), img.Bounds().Dy())
+			}
+		})
+	}
+}
+
+func TestWebPInput(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	imgBuf := new(bytes.Buffer)
+	if err := nativewebp.Encode(imgBuf, img, nil); err != nil {
+		t.Fatalf("Failed to encode WebP fixture: %v", err)
+	}
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("image", "test.webp")
+	part.Write(imgBuf.Bytes())
+	writer.Close()
+	req := createImageUploadRequest("/resize?width=5&height=5", body, writer.FormDataContentType())
+
+	recorder := httptest.NewRecorder()
+	api.ResizeHandler(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestAnimatedGIFInput(t *testing.T) {
+	testCases := []struct {
+		name           string
+		url            string
+		handler        http.HandlerFunc
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{"Resize", "/resize?width=5&height=5", api.ResizeHandler, 5, 5},
+		{"Crop", "/crop?x=2&y=2&width=4&height=6", api.CropHandler, 4, 6},
+		{"Rotate", "/rotate?angle=90", api.RotateHandler, 10, 10},
+		{"Flip", "/flip?direction=vertical", api.FlipHandler, 10, 10},
+		{"Convert", "/convert?format=gif", api.ConvertHandler, 10, 10},
+		{"Process", "/process?ops=resize:4x8|format:gif", api.ProcessHandler, 4, 8},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			imgBuf, err := createDummyAnimatedGIF()
+			if err != nil {
+				t.Fatalf("Failed to create animated GIF: %v", err)
+			}
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "test.gif")
+			part.Write(imgBuf.Bytes())
+			writer.Close()
+			req := createImageUploadRequest(tc.url, body, writer.FormDataContentType())
+
+			recorder := httptest.NewRecorder()
+			tc.handler(recorder, req)
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+			}
+			if contentType := recorder.Header().Get("Content-Type"); contentType != "image/gif" {
+				t.Errorf("Expected Content-Type image/gif, got %s", contentType)
+			}
+
+			anim, err := gif.DecodeAll(recorder.Body)
+			if err != nil {
+				t.Fatalf("Failed to decode response GIF: %v", err)
+			}
+			if len(anim.Image) != 3 {
+				t.Fatalf("Expected 3 frames, got %d", len(anim.Image))
+			}
+			if anim.LoopCount != 2 {
+				t.Errorf("Expected loop count 2, got %d", anim.LoopCount)
+			}
+			for i, delay := range anim.Delay {
+				if delay != 10*(i+1) {
+					t.Errorf("Frame %d: expected delay %d, got %d", i, 10*(i+1), delay)
+				}
+			}
+			if anim.Config.Width != tc.expectedWidth || anim.Config.Height != tc.expectedHeight {
+				t.Errorf("Expected dimensions %dx%d, got %dx%d", tc.expectedWidth, tc.expectedHeight, anim.Config.Width, anim.Config.Height)
+			}
+		})
+	}
+}
+
+func TestAnimatedGIFTransparency(t *testing.T) {
+	red, blue := color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}
+
+	// Frame 0 is red on the left half and transparent on the right. Frame 1 only covers
+	// the top-right quadrant, in blue from its own palette, leaving the red of frame 0
+	// and the transparent bottom-right quadrant showing.
+	anim := &gif.GIF{Delay: []int{10, 10}, Disposal: []byte{gif.DisposalNone, gif.DisposalNone}}
+	first := image.NewPaletted(image.Rect(0, 0, 10, 10), color.Palette{color.Transparent, red})
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 5; x++ {
+			first.SetColorIndex(x, y, 1)
+		}
+	}
+	second := image.NewPaletted(image.Rect(5, 0, 10, 5), color.Palette{blue})
+	anim.Image = []*image.Paletted{first, second}
+	imgBuf := new(bytes.Buffer)
+	if err := gif.EncodeAll(imgBuf, anim); err != nil {
+		t.Fatalf("Failed to create animated GIF: %v", err)
+	}
+
+	// expect lists, per output frame, pixels and the color they must have; nil means
+	// transparent.
+	type pixel struct {
+		x, y  int
+		color color.Color
+	}
+	testCases := []struct {
+		name    string
+		url     string
+		handler http.HandlerFunc
+		expect  [2][]pixel
+	}{
+		{"Flip", "/flip?direction=horizontal", api.FlipHandler, [2][]pixel{
+			{{2, 2, nil}, {2, 7, nil}, {7, 7, red}},
+			{{2, 2, blue}, {2, 7, nil}, {7, 7, red}},
+		}},
+		{"Rotate Corners", "/rotate?angle=45", api.RotateHandler, [2][]pixel{
+			{{0, 0, nil}},
+			{{0, 0, nil}},
+		}},
+		{"Contain Padding", "/resize?width=20&height=10&fit=contain&filter=nearest", api.ResizeHandler, [2][]pixel{
+			{{2, 5, nil}, {7, 5, red}, {17, 5, nil}},
+			{{2, 5, nil}, {7, 5, red}, {12, 2, blue}, {17, 5, nil}},
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "test.gif")
+			part.Write(imgBuf.Bytes())
+			writer.Close()
+			req := createImageUploadRequest(tc.url, body, writer.FormDataContentType())
+
+			recorder := httptest.NewRecorder()
+			tc.handler(recorder, req)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+			}
+
+			out, err := gif.DecodeAll(recorder.Body)
+			if err != nil {
+				t.Fatalf("Failed to decode response GIF: %v", err)
+			}
+			if len(out.Image) != 2 {
+				t.Fatalf("Expected 2 frames, got %d", len(out.Image))
+			}
+			for i, pixels := range tc.expect {
+				for _, p := range pixels {
+					r, g, b, a := out.Image[i].At(p.x, p.y).RGBA()
+					if p.color == nil {
+						if a != 0 {
+							t.Errorf("Frame %d: expected (%d,%d) to be transparent, got %v", i, p.x, p.y, out.Image[i].At(p.x, p.y))
+						}
+						continue
+					}
+					er, eg, eb, ea := p.color.RGBA()
+					if r != er || g != eg || b != eb || a != ea {
+						t.Errorf("Frame %d: expected (%d,%d) to be %v, got %v", i, p.x, p.y, p.color, out.Image[i].At(p.x, p.y))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestStillGIFTransparency(t *testing.T) {
+	red := color.RGBA{R: 255, A: 255}
+
+	// A still 10x10 GIF, red on the left half and transparent on the right.
+	img := image.NewPaletted(image.Rect(0, 0, 10, 10), color.Palette{color.Transparent, red})
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 5; x++ {
+			img.SetColorIndex(x, y, 1)
+		}
+	}
+	imgBuf := new(bytes.Buffer)
+	if err := gif.Encode(imgBuf, img, nil); err != nil {
+		t.Fatalf("Failed to create GIF: %v", err)
+	}
+
+	testCases := []struct {
+		name        string
+		url         string
+		handler     http.HandlerFunc
+		red         image.Point
+		transparent image.Point
+	}{
+		{"Flip", "/flip?direction=horizontal", api.FlipHandler, image.Pt(7, 5), image.Pt(2, 5)},
+		{"Rotate", "/rotate?angle=90", api.RotateHandler, image.Pt(5, 7), image.Pt(5, 2)},
+		{"Crop", "/crop?x=3&y=0&width=4&height=4", api.CropHandler, image.Pt(0, 0), image.Pt(3, 0)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "test.gif")
+			part.Write(imgBuf.Bytes())
+			writer.Close()
+			req := createImageUploadRequest(tc.url, body, writer.FormDataContentType())
+
+			recorder := httptest.NewRecorder()
+			tc.handler(recorder, req)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+			}
+
+			out, err := gif.Decode(recorder.Body)
+			if err != nil {
+				t.Fatalf("Failed to decode response GIF: %v", err)
+			}
+			if r, g, b, a := out.At(tc.red.X, tc.red.Y).RGBA(); r != 0xFFFF || g != 0 || b != 0 || a != 0xFFFF {
+				t.Errorf("Expected %v to be red, got %v", tc.red, out.At(tc.red.X, tc.red.Y))
+			}
+			if _, _, _, a := out.At(tc.transparent.X, tc.transparent.Y).RGBA(); a != 0 {
+				t.Errorf("Expected %v to be transparent, got %v", tc.transparent, out.At(tc.transparent.X, tc.transparent.Y))
+			}
+		})
+	}
+}
+
+func TestGIFPartialFirstFrame(t *testing.T) {
+	red := color.RGBA{R: 255, A: 255}
+
+	// createGIF returns a 20x20 GIF whose first frame only covers (5,5)-(10,10), in red,
+	// followed by frames-1 further frames of the same region.
+	createGIF := func(frames int) []byte {
+		anim := &gif.GIF{Config: image.Config{ColorModel: color.Palette{color.Transparent, red}, Width: 20, Height: 20}}
+		for i := 0; i < frames; i++ {
+			frame := image.NewPaletted(image.Rect(5, 5, 10, 10), color.Palette{color.Transparent, red})
+			for p := range frame.Pix {
+				frame.Pix[p] = 1
+			}
+			anim.Image = append(anim.Image, frame)
+			anim.Delay = append(anim.Delay, 10)
+		}
+		buf := new(bytes.Buffer)
+		if err := gif.EncodeAll(buf, anim); err != nil {
+			t.Fatalf("Failed to create GIF: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	testCases := []struct {
+		name        string
+		url         string
+		handler     http.HandlerFunc
+		frames      int
+		red         image.Point
+		transparent image.Point
+	}{
+		{"Full Crop", "/crop?x=0&y=0&width=20&height=20", api.CropHandler, 1, image.Pt(7, 7), image.Pt(2, 2)},
+		{"Flip To PNG", "/flip?direction=horizontal&format=png", api.FlipHandler, 1, image.Pt(12, 7), image.Pt(7, 7)},
+		{"Animated Full Crop", "/crop?x=0&y=0&width=20&height=20", api.CropHandler, 2, image.Pt(7, 7), image.Pt(2, 2)},
+		{"Animated Pipeline", "/process?ops=flip:horizontal|crop:0,0,20,20", api.ProcessHandler, 2, image.Pt(12, 7), image.Pt(7, 7)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "test.gif")
+			part.Write(createGIF(tc.frames))
+			writer.Close()
+			req := createImageUploadRequest(tc.url, body, writer.FormDataContentType())
+
+			recorder := httptest.NewRecorder()
+			tc.handler(recorder, req)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+			}
+
+			out, _, err := image.Decode(recorder.Body)
+			if err != nil {
+				t.Fatalf("Failed to decode response image: %v", err)
+			}
+			if out.Bounds() != image.Rect(0, 0, 20, 20) {
+				t.Fatalf("Expected a 20x20 image, got %v", out.Bounds())
+			}
+			if r, _, _, a := out.At(tc.red.X, tc.red.Y).RGBA(); r != 0xFFFF || a != 0xFFFF {
+				t.Errorf("Expected %v to be red, got %v", tc.red, out.At(tc.red.X, tc.red.Y))
+			}
+			if _, _, _, a := out.At(tc.transparent.X, tc.transparent.Y).RGBA(); a != 0 {
+				t.Errorf("Expected %v to be transparent, got %v", tc.transparent, out.At(tc.transparent.X, tc.transparent.Y))
+			}
+		})
+	}
+}
+
+func TestOutputFormatNegotiation(t *testing.T) {
+	testCases := []struct {
+		name               string
+		url                string
+		accept             string
+		expectedStatusCode int
+		expectedMimeType   string
+	}{
+		{"Source Format Preserved", "/rotate?angle=90", "", http.StatusOK, "image/png"},
+		{"Explicit Format Override", "/rotate?angle=90&format=jpeg", "", http.StatusOK, "image/jpeg"},
+		{"Format Override Beats Accept", "/rotate?angle=90&format=webp", "image/jpeg", http.StatusOK, "image/webp"},
+		{"Accept Wildcard Keeps Source", "/rotate?angle=90", "image/*", http.StatusOK, "image/png"},
+		{"Accept Prefers Other Format", "/rotate?angle=90", "image/webp", http.StatusOK, "image/webp"},
+		{"Accept With Quality Values", "/rotate?angle=90", "image/png;q=0.5, image/jpeg", http.StatusOK, "image/jpeg"},
+		{"Failure - Not Acceptable", "/rotate?angle=90", "text/html", http.StatusNotAcceptable, ""},
+		{"Failure - Invalid Format", "/rotate?angle=90&format=bmp", "", http.StatusBadRequest, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			imgBuf, _ := createDummyImage()
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "test.png")
+			part.Write(imgBuf.Bytes())
+			writer.Close()
+			req := createImageUploadRequest(tc.url, body, writer.FormDataContentType())
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+
+			recorder := httptest.NewRecorder()
+			api.RotateHandler(recorder, req)
+
+			if recorder.Code != tc.expectedStatusCode {
+				t.Fatalf("Expected status code %d, got %d: %s", tc.expectedStatusCode, recorder.Code, recorder.Body.String())
+			}
+			if recorder.Code == http.StatusOK {
+				if contentType := recorder.Header().Get("Content-Type"); contentType != tc.expectedMimeType {
+					t.Errorf("Expected Content-Type %s, got %s", tc.expectedMimeType, contentType)
+				}
+			}
+		})
+	}
+}
+
+func TestEXIFOrientation(t *testing.T) {
+	testCases := []struct {
+		name           string
+		orientation    uint16
+		url            string
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{"Normal Orientation", 1, "/convert?format=png", 10, 6},
+		{"Mirrored Keeps Dimensions", 2, "/convert?format=png", 10, 6},
+		{"Rotated 90 CW Is Corrected", 6, "/convert?format=png", 6, 10},
+		{"Rotated 90 CCW Is Corrected", 8, "/convert?format=png", 6, 10},
+		{"Transposed Is Corrected", 5, "/convert?format=png", 6, 10},
+		{"Autorotate Disabled", 6, "/convert?format=png&autorotate=false", 10, 6},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			imgBuf, err := createDummyJPEGWithOrientation(tc.orientation)
+			if err != nil {
+				t.Fatalf("Failed to create JPEG: %v", err)
+			}
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "test.jpg")
+			part.Write(imgBuf.Bytes())
+			writer.Close()
+			req := createImageUploadRequest(tc.url, body, writer.FormDataContentType())
+
+			recorder := httptest.NewRecorder()
+			api.ConvertHandler(recorder, req)
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+			}
+
+			img, _, err := image.Decode(recorder.Body)
+			if err != nil {
+				t.Fatalf("Failed to decode response image: %v", err)
+			}
+			if img.Bounds().Dx() != tc.expectedWidth || img.Bounds().Dy() != tc.expectedHeight {
+				t.Errorf("Expected image dimensions %dx%d, got %dx%d", tc.expectedWidth, tc.expectedHeight, img.Bounds().Dx(), img.Bounds().Dy())
+			}
+		})
+	}
+}
+
+func TestInfoHandler(t *testing.T) {
+	xmpPacket := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:CreatorTool="gips">` +
+		`<dc:rights><rdf:Alt><rdf:li xml:lang="x-default">(c) Example</rdf:li></rdf:Alt></dc:rights>` +
+		`</rdf:Description></rdf:RDF></x:xmpmeta>`
+
+	testCases := []struct {
+		name               string
+		file               func() []byte
+		expectedStatusCode int
+		checkInfo          func(t *testing.T, info map[string]any)
+	}{
+		{
+			name: "Success - PNG",
+			file: func() []byte {
+				imgBuf, _ := createDummyImage()
+				return imgBuf.Bytes()
+			},
+			expectedStatusCode: http.StatusOK,
+			checkInfo: func(t *testing.T, info map[string]any) {
+				if info["format"] != "png" || info["width"] != 10.0 || info["height"] != 10.0 {
+					t.Errorf("Unexpected format or dimensions: %v", info)
+				}
+				if info["bit_depth"] != 8.0 || info["has_alpha"] != true || info["frames"] != 1.0 {
+					t.Errorf("Unexpected bit depth, alpha or frames: %v", info)
+				}
+			},
+		},
+		{
+			name: "Success - JPEG With EXIF And XMP",
+			file: func() []byte {
+				imgBuf, _ := createDummyJPEGWithOrientation(6)
+				payload := append([]byte("http://ns.adobe.com/xap/1.0/\x00"), xmpPacket...)
+				return insertJPEGSegment(imgBuf.Bytes(), 0xE1, payload).Bytes()
+			},
+			expectedStatusCode: http.StatusOK,
+			checkInfo: func(t *testing.T, info map[string]any) {
+				if info["format"] != "jpeg" || info["color_model"] != "YCbCr" || info["has_alpha"] != false {
+					t.Errorf("Unexpected format, color model or alpha: %v", info)
+				}
+				if info["orientation"] != 6.0 {
+					t.Errorf("Expected orientation 6, got %v", info["orientation"])
+				}
+				exif, _ := info["exif"].(map[string]any)
+				if exif["Orientation"] != 6.0 {
+					t.Errorf("Expected EXIF Orientation 6, got %v", info["exif"])
+				}
+				xmp, _ := info["xmp"].(map[string]any)
+				if xmp["xmp:CreatorTool"] != "gips" || xmp["dc:rights"] != "(c) Example" {
+					t.Errorf("Unexpected XMP fields: %v", info["xmp"])
+				}
+			},
+		},
+		{
+			name: "Success - Animated GIF",
+			file: func() []byte {
+				imgBuf, _ := createDummyAnimatedGIF()
+				return imgBuf.Bytes()
+			},
+			expectedStatusCode: http.StatusOK,
+			checkInfo: func(t *testing.T, info map[string]any) {
+				if info["format"] != "gif" || info["color_model"] != "Paletted" || info["frames"] != 3.0 {
+					t.Errorf("Unexpected format, color model or frames: %v", info)
+				}
+			},
+		},
+		{
+			name: "Failure - Non-Image File",
+			file: func() []byte {
+				return []byte("this is not an image")
+			},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "upload")
+			part.Write(tc.file())
+			writer.Close()
+			req := createImageUploadRequest("/info", body, writer.FormDataContentType())
+
+			recorder := httptest.NewRecorder()
+			api.InfoHandler(recorder, req)
+
+			if recorder.Code != tc.expectedStatusCode {
+				t.Fatalf("Expected status code %d, got %d: %s", tc.expectedStatusCode, recorder.Code, recorder.Body.String())
+			}
+
+			if tc.checkInfo != nil {
+				var info map[string]any
+				if err := json.NewDecoder(recorder.Body).Decode(&info); err != nil {
+					t.Fatalf("Failed to decode response JSON: %v", err)
+				}
+				tc.checkInfo(t, info)
+			}
+		})
+	}
+}
+
+func TestMetadataControls(t *testing.T) {
+	testCases := []struct {
+		name                string
+		url                 string
+		handler             http.HandlerFunc
+		expectedOrientation float64
+		expectMetadata      bool
+		expectGPS           bool
+		shortGPSPointer     bool
+		longOrientation     bool
+	}{
+		{"Compress - Default Strips", "/compress", api.CompressHandler, 0, false, false, false, false},
+		{"Compress - Keep", "/compress?metadata=keep", api.CompressHandler, 1, true, true, false, false},
+		{"Compress - Strip GPS", "/compress?metadata=strip-gps", api.CompressHandler, 1, true, false, false, false},
+		{"Compress - Strip GPS With SHORT Pointer", "/compress?metadata=strip-gps", api.CompressHandler, 1, true, false, true, false},
+		{"Compress - Keep With LONG Orientation", "/compress?metadata=keep", api.CompressHandler, 1, true, true, false, true},
+		{"Compress - Keep Without Autorotate", "/compress?metadata=keep&autorotate=false", api.CompressHandler, 6, true, true, false, false},
+		{"Convert to PNG - Keep", "/convert?format=png&metadata=keep", api.ConvertHandler, 1, true, true, false, false},
+		{"Convert to WebP - Strip GPS", "/convert?format=webp&metadata=strip-gps", api.ConvertHandler, 1, true, false, false, false},
+		{"Resize - Keep", "/resize?width=5&metadata=keep", api.ResizeHandler, 1, true, true, false, false},
+		{"Process - Strip GPS", "/process?ops=flip:horizontal|metadata:strip-gps", api.ProcessHandler, 1, true, false, false, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			imgBuf, err := createDummyJPEGWithMetadata(tc.shortGPSPointer, tc.longOrientation)
+			if err != nil {
+				t.Fatalf("Failed to create JPEG: %v", err)
+			}
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "test.jpg")
+			part.Write(imgBuf.Bytes())
+			writer.Close()
+
+			recorder := httptest.NewRecorder()
+			tc.handler(recorder, createImageUploadRequest(tc.url, body, writer.FormDataContentType()))
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+			}
+			// The GPSLatitudeRef entry must not survive as orphaned bytes either.
+			gpsEntry := []byte{0x00, 0x01, 0, 2, 0, 0, 0, 2, 'N', 0}
+			if !tc.expectGPS && bytes.Contains(recorder.Body.Bytes(), gpsEntry) {
+				t.Errorf("Expected the GPS directory to be removed from the output")
+			}
+
+			// Inspect the output through /info.
+			body = new(bytes.Buffer)
+			writer = multipart.NewWriter(body)
+			part, _ = writer.CreateFormFile("image", "output")
+			part.Write(recorder.Body.Bytes())
+			writer.Close()
+
+			infoRecorder := httptest.NewRecorder()
+			api.InfoHandler(infoRecorder, createImageUploadRequest("/info", body, writer.FormDataContentType()))
+			var info map[string]any
+			if err := json.NewDecoder(infoRecorder.Body).Decode(&info); err != nil {
+				t.Fatalf("Failed to decode info JSON: %v", err)
+			}
+
+			_, hasICC := info["icc"]
+			_, hasXMP := info["xmp"]
+			if hasICC != tc.expectMetadata || hasXMP != tc.expectMetadata {
+				t.Errorf("Expected ICC and XMP present=%v, got icc=%v xmp=%v", tc.expectMetadata, hasICC, hasXMP)
+			}
+
+			exif, _ := info["exif"].(map[string]any)
+			if orientation, _ := exif["Orientation"].(float64); orientation != tc.expectedOrientation {
+				t.Errorf("Expected EXIF Orientation %v, got %v", tc.expectedOrientation, exif["Orientation"])
+			}
+			if _, hasGPS := exif["GPSLatitudeRef"]; hasGPS != tc.expectGPS {
+				t.Errorf("Expected GPS present=%v, got exif=%v", tc.expectGPS, exif)
+			}
+			xmp, _ := info["xmp"].(map[string]any)
+			_, hasLatitude := xmp["exif:GPSLatitude"]
+			_, hasLongitude := xmp["exif:GPSLongitude"]
+			if hasLatitude != tc.expectGPS || hasLongitude != tc.expectGPS {
+				t.Errorf("Expected XMP GPS present=%v, got xmp=%v", tc.expectGPS, xmp)
+			}
+			if _, hasRights := xmp["dc:rights"]; hasRights != tc.expectMetadata {
+				t.Errorf("Expected XMP dc:rights present=%v, got xmp=%v", tc.expectMetadata, xmp)
+			}
+		})
+	}
+}
+
+func TestRotateHandlerBounds(t *testing.T) {
+	testCases := []struct {
+		name           string
+		url            string
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{"Expanded 45 Degrees", "/rotate?angle=45", 15, 15},
+		{"Fixed Canvas 45 Degrees", "/rotate?angle=45&expand=false", 10, 10},
+		{"Right Angle", "/rotate?angle=-270", 10, 10},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			imgBuf, _ := createDummyImage()
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "test.png")
+			part.Write(imgBuf.Bytes())
+			writer.Close()
+			req := createImageUploadRequest(tc.url, body, writer.FormDataContentType())
+
+			recorder := httptest.NewRecorder()
+			api.RotateHandler(recorder, req)
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+			}
+			img, _, err := image.Decode(recorder.Body)
+			if err != nil {
+				t.Fatalf("Failed to decode response image: %v", err)
+			}
+			if img.Bounds().Dx() != tc.expectedWidth || img.Bounds().Dy() != tc.expectedHeight {
+				t.Errorf("Expected image dimensions %dx%d, got %dx%d", tc.expectedWidth, tc.expectedHeight, img.Bounds().Dx(), img.Bounds().Dy())
+			}
+		})
+	}
+}
+
+func TestResizeFitModes(t *testing.T) {
+	testCases := []struct {
+		name           string
+		url            string
+		expectedStatus int
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{"Fill", "/resize?width=8&height=8", http.StatusOK, 8, 8},
+		{"Cover", "/resize?width=8&height=8&fit=cover", http.StatusOK, 8, 8},
+		{"Cover With Gravity", "/resize?width=8&height=8&fit=cover&gravity=east", http.StatusOK, 8, 8},
+		{"Contain", "/resize?width=8&height=8&fit=contain&background=%23FFFFFF", http.StatusOK, 8, 8},
+		{"Inside", "/resize?width=8&height=8&fit=inside", http.StatusOK, 8, 4},
+		{"Outside", "/resize?width=8&height=8&fit=outside", http.StatusOK, 16, 8},
+		{"Single Dimension", "/resize?height=5&fit=cover", http.StatusOK, 10, 5},
+		{"Fill Without Enlargement", "/resize?width=40&height=40&withoutEnlargement=true", http.StatusOK, 20, 10},
+		{"Inside Without Enlargement", "/resize?width=40&height=40&fit=inside&withoutEnlargement=true", http.StatusOK, 20, 10},
+		{"Cover Without Enlargement", "/resize?width=15&height=15&fit=cover&withoutEnlargement=true", http.StatusOK, 15, 10},
+		{"Contain Without Enlargement", "/resize?width=40&height=40&fit=contain&withoutEnlargement=true", http.StatusOK, 40, 40},
+		{"Invalid Fit", "/resize?width=8&height=8&fit=squash", http.StatusBadRequest, 0, 0},
+		{"Invalid Gravity", "/resize?width=8&height=8&fit=cover&gravity=up", http.StatusBadRequest, 0, 0},
+		{"Invalid Background", "/resize?width=8&height=8&fit=contain&background=white", http.StatusBadRequest, 0, 0},
+		{"Invalid Without Enlargement", "/resize?width=8&withoutEnlargement=maybe", http.StatusBadRequest, 0, 0},
+		{"Negative Width", "/resize?width=-8", http.StatusBadRequest, 0, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			imgBuf, _ := createDummyWideImage()
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "test.png")
+			part.Write(imgBuf.Bytes())
+			writer.Close()
+			req := createImageUploadRequest(tc.url, body, writer.FormDataContentType())
+
+			recorder := httptest.NewRecorder()
+			api.ResizeHandler(recorder, req)
+
+			if recorder.Code != tc.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d: %s", tc.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+			img, _, err := image.Decode(recorder.Body)
+			if err != nil {
+				t.Fatalf("Failed to decode response image: %v", err)
+			}
+			if img.Bounds().Dx() != tc.expectedWidth || img.Bounds().Dy() != tc.expectedHeight {
+				t.Errorf("Expected image dimensions %dx%d, got %dx%d", tc.expectedWidth, tc.expectedHeight, img.Bounds().Dx(), img.Bounds().Dy())
+			}
+		})
+	}
+}
+
+func TestResizeResampling(t *testing.T) {
+	// A two-color checkerboard, so nearest-neighbor output must not contain blended colors.
+	checkerboard := image.NewRGBA(image.Rect(0, 0, 40, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 40; x++ {
+			if (x/4+y/4)%2 == 0 {
+				checkerboard.Set(x, y, color.White)
+			} else {
+				checkerboard.Set(x, y, color.Black)
+			}
+		}
+	}
+
+	testCases := []struct {
+		name           string
+		url            string
+		expectedStatus int
+		expectedWidth  int
+		onlyTwoColors  bool
+	}{
+		{"Nearest", "/resize?width=80&filter=nearest", http.StatusOK, 80, true},
+		{"Box", "/resize?width=20&filter=box", http.StatusOK, 20, false},
+		{"Linear", "/resize?width=20&filter=linear", http.StatusOK, 20, false},
+		{"Cubic", "/resize?width=20&filter=cubic", http.StatusOK, 20, false},
+		{"Lanczos Pre-Shrink", "/resize?width=5&filter=lanczos", http.StatusOK, 5, false},
+		{"Invalid Filter", "/resize?width=20&filter=bilinear", http.StatusBadRequest, 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			imgBuf := new(bytes.Buffer)
+			png.Encode(imgBuf, checkerboard)
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "test.png")
+			part.Write(imgBuf.Bytes())
+			writer.Close()
+			req := createImageUploadRequest(tc.url, body, writer.FormDataContentType())
+
+			recorder := httptest.NewRecorder()
+			api.ResizeHandler(recorder, req)
+
+			if recorder.Code != tc.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d: %s", tc.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+			img, _, err := image.Decode(recorder.Body)
+			if err != nil {
+				t.Fatalf("Failed to decode response image: %v", err)
+			}
+			if img.Bounds().Dx() != tc.expectedWidth || img.Bounds().Dy() != tc.expectedWidth {
+				t.Errorf("Expected image dimensions %dx%d, got %dx%d", tc.expectedWidth, tc.expectedWidth, img.Bounds().Dx(), img.Bounds().Dy())
+			}
+			if tc.onlyTwoColors {
+				for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+					for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+						r, _, _, _ := img.At(x, y).RGBA()
+						if r != 0 && r != 0xffff {
+							t.Fatalf("Expected only black and white pixels, got %v at (%d, %d)", img.At(x, y), x, y)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSmartCropHandler(t *testing.T) {
+	// A flat gray 40x10 image with a saturated, noisy patch on its right edge.
+	img := image.NewRGBA(image.Rect(0, 0, 40, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 40; x++ {
+			img.Set(x, y, color.Gray{Y: 128})
+			if x >= 30 && (x+y)%2 == 0 {
+				img.Set(x, y, color.RGBA{R: 255, G: 40, B: 40, A: 255})
+			}
+		}
+	}
+
+	testCases := []struct {
+		name           string
+		url            string
+		handler        http.HandlerFunc
+		expectedStatus int
+		expectedRect   string
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{"Smart Crop", "/smartcrop?width=5&height=5", api.SmartCropHandler, http.StatusOK, "30,0,10,10", 5, 5},
+		{"Resize Cover Auto", "/resize?width=5&height=5&fit=cover&crop=auto", api.ResizeHandler, http.StatusOK, "30,0,10,10", 5, 5},
+		{"Process Cover Auto", "/process?ops=resize:width=5,height=5,fit=cover,crop=auto", api.ProcessHandler, http.StatusOK, "30,0,10,10", 5, 5},
+		{"Process Cover Auto After Flip", "/process?ops=flip:horizontal|resize:width=5,height=5,fit=cover,crop=auto", api.ProcessHandler, http.StatusOK, "0,0,10,10", 5, 5},
+		{"Without Enlargement", "/smartcrop?width=20&height=20&withoutEnlargement=true", api.SmartCropHandler, http.StatusOK, "30,0,10,10", 10, 10},
+		{"Missing Height", "/smartcrop?width=5", api.SmartCropHandler, http.StatusBadRequest, "", 0, 0},
+		{"Auto Without Cover", "/resize?width=5&height=5&crop=auto", api.ResizeHandler, http.StatusBadRequest, "", 0, 0},
+		{"Invalid Crop", "/resize?width=5&height=5&fit=cover&crop=smart", api.ResizeHandler, http.StatusBadRequest, "", 0, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			imgBuf := new(bytes.Buffer)
+			png.Encode(imgBuf, img)
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "test.png")
+			part.Write(imgBuf.Bytes())
+			writer.Close()
+			req := createImageUploadRequest(tc.url, body, writer.FormDataContentType())
+
+			recorder := httptest.NewRecorder()
+			tc.handler(recorder, req)
+
+			if recorder.Code != tc.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d: %s", tc.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+			if rect := recorder.Header().Get("X-Crop-Rect"); rect != tc.expectedRect {
+				t.Errorf("Expected X-Crop-Rect %q, got %q", tc.expectedRect, rect)
+			}
+			out, _, err := image.Decode(recorder.Body)
+			if err != nil {
+				t.Fatalf("Failed to decode response image: %v", err)
+			}
+			if out.Bounds().Dx() != tc.expectedWidth || out.Bounds().Dy() != tc.expectedHeight {
+				t.Errorf("Expected image dimensions %dx%d, got %dx%d", tc.expectedWidth, tc.expectedHeight, out.Bounds().Dx(), out.Bounds().Dy())
+			}
+		})
+	}
+}
+
+func TestCropHandlerRegions(t *testing.T) {
+	testCases := []struct {
+		name           string
+		url            string
+		expectedStatus int
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{"Gravity Only", "/crop?width=6&height=4&gravity=southeast", http.StatusOK, 6, 4},
+		{"Percentages", "/crop?x=25%25&y=0&width=50%25&height=100%25", http.StatusOK, 10, 10},
+		{"Aspect Largest", "/crop?aspect=1:1", http.StatusOK, 10, 10},
+		{"Aspect With Width", "/crop?width=8&aspect=2:1&gravity=north", http.StatusOK, 8, 4},
+		{"Aspect With Height Percentage", "/crop?height=50%25&aspect=16:9", http.StatusOK, 9, 5},
+		{"Outside Bounds", "/crop?x=15&y=0&width=10&height=5", http.StatusBadRequest, 0, 0},
+		{"Partly Outside Bounds", "/crop?x=-2&y=0&width=5&height=5", http.StatusBadRequest, 0, 0},
+		{"Too Large", "/crop?width=30&height=5", http.StatusBadRequest, 0, 0},
+		{"Empty", "/crop?width=0&height=5", http.StatusBadRequest, 0, 0},
+		{"Invalid Aspect", "/crop?width=5&aspect=wide", http.StatusBadRequest, 0, 0},
+		{"Aspect With Both Sizes", "/crop?width=5&height=5&aspect=1:1", http.StatusBadRequest, 0, 0},
+		{"Invalid Gravity", "/crop?width=5&height=5&gravity=up", http.StatusBadRequest, 0, 0},
+		{"Invalid Percentage", "/crop?width=ten%25&height=5", http.StatusBadRequest, 0, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			imgBuf, _ := createDummyWideImage()
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "test.png")
+			part.Write(imgBuf.Bytes())
+			writer.Close()
+			req := createImageUploadRequest(tc.url, body, writer.FormDataContentType())
+
+			recorder := httptest.NewRecorder()
+			api.CropHandler(recorder, req)
+
+			if recorder.Code != tc.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d: %s", tc.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+			img, _, err := image.Decode(recorder.Body)
+			if err != nil {
+				t.Fatalf("Failed to decode response image: %v", err)
+			}
+			if img.Bounds().Dx() != tc.expectedWidth || img.Bounds().Dy() != tc.expectedHeight {
+				t.Errorf("Expected image dimensions %dx%d, got %dx%d", tc.expectedWidth, tc.expectedHeight, img.Bounds().Dx(), img.Bounds().Dy())
+			}
+		})
+	}
+}
+
+func TestAdjustHandler(t *testing.T) {
+	// A 4x4 opaque orange image.
+	src := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			src.Set(x, y, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+		}
+	}
+
+	testCases := []struct {
+		name           string
+		url            string
+		handler        http.HandlerFunc
+		expectedStatus int
+		// check verifies the color of the top-left pixel of the result.
+		check func(c color.NRGBA) bool
+	}{
+		{"Invert", "/adjust?invert=true", api.AdjustHandler, http.StatusOK, func(c color.NRGBA) bool {
+			return c.R == 55 && c.G == 155 && c.B == 205
+		}},
+		{"Grayscale", "/adjust?grayscale", api.AdjustHandler, http.StatusOK, func(c color.NRGBA) bool {
+			return c.R == c.G && c.G == c.B
+		}},
+		{"Grayscale Disabled", "/adjust?grayscale=false", api.AdjustHandler, http.StatusOK, func(c color.NRGBA) bool {
+			return c.R == 200 && c.G == 100 && c.B == 50
+		}},
+		{"Brightness", "/adjust?brightness=20", api.AdjustHandler, http.StatusOK, func(c color.NRGBA) bool {
+			return c.R > 200 && c.G > 100 && c.B > 50
+		}},
+		{"Combined", "/adjust?contrast=10&gamma=1.2&saturation=-50&hue=30&sepia=50&colorize=200&colorizeAmount=20", api.AdjustHandler, http.StatusOK, nil},
+		{"Pipeline", "/process?ops=grayscale|invert", api.ProcessHandler, http.StatusOK, func(c color.NRGBA) bool {
+			return c.R == c.G && c.G == c.B && c.R > 128
+		}},
+		{"Pipeline Colorize", "/process?ops=colorize:200,50,30|brightness:10", api.ProcessHandler, http.StatusOK, nil},
+		{"Missing Adjustment", "/adjust", api.AdjustHandler, http.StatusBadRequest, nil},
+		{"Brightness Out Of Range", "/adjust?brightness=150", api.AdjustHandler, http.StatusBadRequest, nil},
+		{"Invalid Gamma", "/adjust?gamma=0", api.AdjustHandler, http.StatusBadRequest, nil},
+		{"Invalid Toggle", "/adjust?invert=maybe", api.AdjustHandler, http.StatusBadRequest, nil},
+		{"Pipeline Invalid Hue", "/process?ops=hue:270", api.ProcessHandler, http.StatusBadRequest, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			imgBuf := new(bytes.Buffer)
+			png.Encode(imgBuf, src)
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "test.png")
+			part.Write(imgBuf.Bytes())
+			writer.Close()
+			req := createImageUploadRequest(tc.url, body, writer.FormDataContentType())
+
+			recorder := httptest.NewRecorder()
+			tc.handler(recorder, req)
+
+			if recorder.Code != tc.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d: %s", tc.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+			if contentType := recorder.Header().Get("Content-Type"); contentType != "image/png" {
+				t.Errorf("Expected content type image/png, got %s", contentType)
+			}
+			img, _, err := image.Decode(recorder.Body)
+			if err != nil {
+				t.Fatalf("Failed to decode response image: %v", err)
+			}
+			c := color.NRGBAModel.Convert(img.At(0, 0)).(color.NRGBA)
+			if tc.check != nil && !tc.check(c) {
+				t.Errorf("Unexpected color %v", c)
+			}
+		})
+	}
+}
+
+func TestBlurAndSharpen(t *testing.T) {
+	testCases := []struct {
+		name           string
+		url            string
+		handler        http.HandlerFunc
+		expectedStatus int
+		expectedWidth  int
+	}{
+		{"Blur", "/blur?sigma=1.5", api.BlurHandler, http.StatusOK, 10},
+		{"Blur Missing Sigma", "/blur", api.BlurHandler, http.StatusBadRequest, 0},
+		{"Blur Invalid Sigma", "/blur?sigma=0", api.BlurHandler, http.StatusBadRequest, 0},
+		{"Sharpen Defaults", "/sharpen", api.SharpenHandler, http.StatusOK, 10},
+		{"Unsharp Mask", "/sharpen?sigma=2&amount=1.5&threshold=0.05", api.SharpenHandler, http.StatusOK, 10},
+		{"Sharpen Invalid Amount", "/sharpen?amount=-1", api.SharpenHandler, http.StatusBadRequest, 0},
+		{"Sharpen Invalid Threshold", "/sharpen?threshold=2", api.SharpenHandler, http.StatusBadRequest, 0},
+		{"Resize With Sharpen", "/resize?width=5&sharpen=true", api.ResizeHandler, http.StatusOK, 5},
+		{"Resize Invalid Sharpen", "/resize?width=5&sharpen=maybe", api.ResizeHandler, http.StatusBadRequest, 0},
+		{"Pipeline", "/process?ops=blur:1|sharpen:1,0.5|resize:5x5", api.ProcessHandler, http.StatusOK, 5},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			imgBuf, _ := createDummyImage()
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "test.png")
+			part.Write(imgBuf.Bytes())
+			writer.Close()
+			req := createImageUploadRequest(tc.url, body, writer.FormDataContentType())
+
+			recorder := httptest.NewRecorder()
+			tc.handler(recorder, req)
+
+			if recorder.Code != tc.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d: %s", tc.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+			img, _, err := image.Decode(recorder.Body)
+			if err != nil {
+				t.Fatalf("Failed to decode response image: %v", err)
+			}
+			if img.Bounds().Dx() != tc.expectedWidth {
+				t.Errorf("Expected image width %d, got %d", tc.expectedWidth, img.Bounds().Dx())
+			}
+		})
+	}
+}
+
+func TestWatermarkHandler(t *testing.T) {
+	base := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(base, base.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	baseBuf := new(bytes.Buffer)
+	png.Encode(baseBuf, base)
+
+	logo := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	draw.Draw(logo, logo.Bounds(), image.NewUniform(color.NRGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+	logoBuf := new(bytes.Buffer)
+	png.Encode(logoBuf, logo)
+
+	red := color.NRGBA{R: 255, A: 255}
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+
+	testCases := []struct {
+		name           string
+		url            string
+		withOverlay    bool
+		expectedStatus int
+		// expectedPixels maps pixel positions to their expected colors.
+		expectedPixels map[image.Point]color.NRGBA
+	}{
+		{"Default Southeast", "/watermark", true, http.StatusOK, map[image.Point]color.NRGBA{
+			{9, 9}: red, {8, 8}: red, {7, 7}: white,
+		}},
+		{"Gravity With Offsets", "/watermark?gravity=northwest&offsetX=3&offsetY=1", true, http.StatusOK, map[image.Point]color.NRGBA{
+			{3, 1}: red, {4, 2}: red, {2, 1}: white, {0, 0}: white,
+		}},
+		{"Half Opacity", "/watermark?opacity=0.5", true, http.StatusOK, map[image.Point]color.NRGBA{
+			{9, 9}: {R: 255, G: 127, B: 127, A: 255},
+		}},
+		{"Scaled", "/watermark?scale=0.5&gravity=center", true, http.StatusOK, map[image.Point]color.NRGBA{
+			{2, 2}: red, {6, 6}: red, {1, 1}: white, {7, 7}: white,
+		}},
+		{"Tiled", "/watermark?tile=true&spacing=2", true, http.StatusOK, map[image.Point]color.NRGBA{
+			{0, 0}: red, {1, 1}: red, {2, 2}: white, {3, 3}: white, {4, 4}: red, {9, 9}: red,
+		}},
+		{"Missing Overlay", "/watermark", false, http.StatusBadRequest, nil},
+		{"Invalid Opacity", "/watermark?opacity=2", true, http.StatusBadRequest, nil},
+		{"Invalid Scale", "/watermark?scale=0", true, http.StatusBadRequest, nil},
+		{"Invalid Offset", "/watermark?offsetX=left", true, http.StatusBadRequest, nil},
+		{"Invalid Gravity", "/watermark?gravity=up", true, http.StatusBadRequest, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "base.png")
+			part.Write(baseBuf.Bytes())
+			if tc.withOverlay {
+				part, _ = writer.CreateFormFile("overlay", "logo.png")
+				part.Write(logoBuf.Bytes())
+			}
+			writer.Close()
+			req := createImageUploadRequest(tc.url, body, writer.FormDataContentType())
+
+			recorder := httptest.NewRecorder()
+			api.WatermarkHandler(recorder, req)
+
+			if recorder.Code != tc.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d: %s", tc.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+			img, _, err := image.Decode(recorder.Body)
+			if err != nil {
+				t.Fatalf("Failed to decode response image: %v", err)
+			}
+			if img.Bounds().Dx() != 10 || img.Bounds().Dy() != 10 {
+				t.Errorf("Expected image dimensions 10x10, got %dx%d", img.Bounds().Dx(), img.Bounds().Dy())
+			}
+			for pt, expected := range tc.expectedPixels {
+				if c := color.NRGBAModel.Convert(img.At(pt.X, pt.Y)).(color.NRGBA); c != expected {
+					t.Errorf("Expected color %v at %v, got %v", expected, pt, c)
+				}
+			}
+		})
+	}
+}
+
+func TestTextWatermark(t *testing.T) {
+	base := image.NewRGBA(image.Rect(0, 0, 200, 60))
+	draw.Draw(base, base.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+
+	// litHalves reports whether the text was drawn in the left or right half of the image.
+	litHalves := func(img image.Image) (left, right bool) {
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if r, _, _, _ := img.At(x, y).RGBA(); r > 0x8000 {
+					if x < b.Dx()/2 {
+						left = true
+					} else {
+						right = true
+					}
+				}
+			}
+		}
+		return left, right
+	}
+
+	testCases := []struct {
+		name           string
+		url            string
+		handler        http.HandlerFunc
+		expectedStatus int
+		expectedLeft   bool
+		expectedRight  bool
+	}{
+		{"Default Southeast", "/watermark?text=%C2%A9%202026", api.WatermarkHandler, http.StatusOK, false, true},
+		{"Northwest With Effects", "/watermark?text=Hi&gravity=northwest&size=20&color=%23FFFF00&shadow=%23808080&outline=%23FF0000&outlineWidth=2", api.WatermarkHandler, http.StatusOK, true, false},
+		{"Bold Multiline", "/watermark?text=one%0Atwo&font=bold&size=12&padding=0&gravity=west", api.WatermarkHandler, http.StatusOK, true, false},
+		{"Pipeline", "/process?ops=text:ok,16|resize:100x30", api.ProcessHandler, http.StatusOK, false, true},
+		{"Missing Text And Overlay", "/watermark", api.WatermarkHandler, http.StatusBadRequest, false, false},
+		{"Invalid Font", "/watermark?text=Hi&font=comic", api.WatermarkHandler, http.StatusBadRequest, false, false},
+		{"Invalid Size", "/watermark?text=Hi&size=1000", api.WatermarkHandler, http.StatusBadRequest, false, false},
+		{"Invalid Color", "/watermark?text=Hi&color=white", api.WatermarkHandler, http.StatusBadRequest, false, false},
+		{"Invalid Padding", "/watermark?text=Hi&padding=-5", api.WatermarkHandler, http.StatusBadRequest, false, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			imgBuf := new(bytes.Buffer)
+			png.Encode(imgBuf, base)
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "base.png")
+			part.Write(imgBuf.Bytes())
+			writer.Close()
+			req := createImageUploadRequest(tc.url, body, writer.FormDataContentType())
+
+			recorder := httptest.NewRecorder()
+			tc.handler(recorder, req)
+
+			if recorder.Code != tc.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d: %s", tc.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+			img, _, err := image.Decode(recorder.Body)
+			if err != nil {
+				t.Fatalf("Failed to decode response image: %v", err)
+			}
+			if left, right := litHalves(img); left != tc.expectedLeft || right != tc.expectedRight {
+				t.Errorf("Expected text in left/right halves %v/%v, got %v/%v", tc.expectedLeft, tc.expectedRight, left, right)
+			}
+		})
+	}
+}
+
+func TestPixelLimits(t *testing.T) {
+	defer api.Configure(api.DefaultSettings())
+
+	narrow := api.DefaultSettings()
+	narrow.MaxWidth = 5
+	// fitted takes the 10x10 upload, but not the wider canvas of a 45 degree rotation.
+	fitted := api.DefaultSettings()
+	fitted.MaxWidth = 12
+	// tiny allows 1000 pixels: one 10x10 frame fits, 50 of them do not.
+	tiny := api.DefaultSettings()
+	tiny.MaxMegapixels = 0.001
+	manyFrames := func() *bytes.Buffer { return createManyFrameGIF(10, 10, 50) }
+	threeFrames := func() *bytes.Buffer { return createManyFrameGIF(10, 10, 3) }
+	// longText at the largest font size needs a canvas of hundreds of megapixels.
+	longText := strings.Repeat("W", 1000)
+
+	testCases := []struct {
+		name           string
+		url            string
+		handler        http.HandlerFunc
+		image          func() *bytes.Buffer
+		settings       api.Settings
+		expectedStatus int
+	}{
+		{"Decompression Bomb", "/resize?width=10", api.ResizeHandler, func() *bytes.Buffer { return createPNGHeader(50000, 50000) }, api.DefaultSettings(), http.StatusRequestEntityTooLarge},
+		{"Decompression Bomb Pipeline", "/process?ops=flip:horizontal", api.ProcessHandler, func() *bytes.Buffer { return createPNGHeader(50000, 50000) }, api.DefaultSettings(), http.StatusRequestEntityTooLarge},
+		{"Upload Wider Than Max Width", "/flip?direction=horizontal", api.FlipHandler, dummyImage, narrow, http.StatusRequestEntityTooLarge},
+		{"Upload Within Limits", "/flip?direction=horizontal", api.FlipHandler, dummyImage, api.DefaultSettings(), http.StatusOK},
+		{"Resize Output Too Large", "/resize?width=20000&height=20000", api.ResizeHandler, dummyImage, api.DefaultSettings(), http.StatusRequestEntityTooLarge},
+		{"Resize Derived Height Too Large", "/resize?width=20000", api.ResizeHandler, dummyImage, api.DefaultSettings(), http.StatusRequestEntityTooLarge},
+		{"Resize Dimension Out Of Range", "/resize?width=100000", api.ResizeHandler, dummyImage, api.Settings{MaxUploadBytes: 32 << 20}, http.StatusBadRequest},
+		{"Resize Pipeline Output Too Large", "/process?ops=resize:20000x20000", api.ProcessHandler, dummyImage, api.DefaultSettings(), http.StatusRequestEntityTooLarge},
+		{"Smart Crop Output Too Large", "/smartcrop?width=20000&height=20000", api.SmartCropHandler, dummyImage, api.DefaultSettings(), http.StatusRequestEntityTooLarge},
+		{"Rotate Output Too Large", "/rotate?angle=45", api.RotateHandler, dummyImage, fitted, http.StatusRequestEntityTooLarge},
+		{"Rotate Within Limits", "/rotate?angle=90", api.RotateHandler, dummyImage, fitted, http.StatusOK},
+		{"Resize Within Limits", "/resize?width=20", api.ResizeHandler, dummyImage, api.DefaultSettings(), http.StatusOK},
+		{"GIF Frames Over Pixel Limit", "/flip?direction=horizontal", api.FlipHandler, manyFrames, tiny, http.StatusRequestEntityTooLarge},
+		{"GIF Frames Over Pixel Limit Pipeline", "/process?ops=flip:horizontal", api.ProcessHandler, manyFrames, tiny, http.StatusRequestEntityTooLarge},
+		{"GIF Frames Within Pixel Limit", "/flip?direction=horizontal", api.FlipHandler, threeFrames, tiny, http.StatusOK},
+		{"GIF Resize Output Frames Over Pixel Limit", "/resize?width=20", api.ResizeHandler, threeFrames, tiny, http.StatusRequestEntityTooLarge},
+		{"GIF Pipeline Output Frames Over Pixel Limit", "/process?ops=resize:20x20", api.ProcessHandler, threeFrames, tiny, http.StatusRequestEntityTooLarge},
+		{"Text Canvas Too Large", "/watermark?size=500&text=" + longText, api.WatermarkHandler, dummyImage, api.DefaultSettings(), http.StatusRequestEntityTooLarge},
+		{"Text Canvas Too Large Pipeline", "/process?ops=text:" + longText + ",500", api.ProcessHandler, dummyImage, api.DefaultSettings(), http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			api.Configure(tc.settings)
+
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "test.png")
+			part.Write(tc.image().Bytes())
+			writer.Close()
+			req := createImageUploadRequest(tc.url, body, writer.FormDataContentType())
+
+			recorder := httptest.NewRecorder()
+			tc.handler(recorder, req)
+
+			if recorder.Code != tc.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d: %s", tc.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+			if tc.expectedStatus != http.StatusRequestEntityTooLarge {
+				return
+			}
+			var limitErr struct {
+				Code    string `json:"code"`
+				Message string `json:"error"`
+				Width   int    `json:"width"`
+			}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &limitErr); err != nil {
+				t.Fatalf("Expected a JSON error body, got %q: %v", recorder.Body.String(), err)
+			}
+			if limitErr.Code != "image_too_large" || limitErr.Message == "" || limitErr.Width == 0 {
+				t.Errorf("Unexpected error body: %s", recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	defer api.Configure(api.DefaultSettings())
+
+	// newUpload returns a resize request for an image, by default the 10x10 (100 pixel)
+	// dummy image.
+	newUpload := func(img func() *bytes.Buffer) *http.Request {
+		if img == nil {
+			img = dummyImage
+		}
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("image", "test.png")
+		part.Write(img().Bytes())
+		writer.Close()
+		return createImageUploadRequest("/resize?width=5", body, writer.FormDataContentType())
+	}
+	// threeFrames is a 10x10 GIF of 3 frames, 300 pixels in all.
+	threeFrames := func() *bytes.Buffer { return createManyFrameGIF(10, 10, 3) }
+
+	testCases := []struct {
+		name     string
+		settings api.Settings
+		// image is uploaded by the second request; nil selects the dummy image.
+		image func() *bytes.Buffer
+		// cancelAfter, when set, cancels the second request after that long.
+		cancelAfter time.Duration
+		// releaseEarly finishes the first request while the second waits for admission;
+		// otherwise it runs until the second has been answered.
+		releaseEarly   bool
+		expectedStatus int
+	}{
+		{"Unlimited", api.Settings{MaxUploadBytes: 32 << 20}, nil, 0, false, http.StatusOK},
+		{"Free Slot", api.Settings{MaxUploadBytes: 32 << 20, MaxConcurrentJobs: 2}, nil, 0, false, http.StatusOK},
+		{"Busy Without Queue", api.Settings{MaxUploadBytes: 32 << 20, MaxConcurrentJobs: 1}, nil, 0, false, http.StatusServiceUnavailable},
+		{"Queue Timeout", api.Settings{MaxUploadBytes: 32 << 20, MaxConcurrentJobs: 1, QueueDepth: 1, QueueTimeout: 50 * time.Millisecond}, nil, 0, false, http.StatusServiceUnavailable},
+		{"Cancelled While Queued", api.Settings{MaxUploadBytes: 32 << 20, MaxConcurrentJobs: 1, QueueDepth: 1, QueueTimeout: 5 * time.Second}, nil, 50 * time.Millisecond, false, http.StatusServiceUnavailable},
+		{"Admitted From Queue", api.Settings{MaxUploadBytes: 32 << 20, MaxConcurrentJobs: 1, QueueDepth: 1, QueueTimeout: 5 * time.Second}, nil, 0, true, http.StatusOK},
+		{"Pixel Budget Exhausted", api.Settings{MaxUploadBytes: 32 << 20, MaxConcurrentJobs: 2, MaxConcurrentMegapixels: 0.00015}, nil, 0, false, http.StatusServiceUnavailable},
+		{"Pixel Budget Available", api.Settings{MaxUploadBytes: 32 << 20, MaxConcurrentJobs: 2, MaxConcurrentMegapixels: 0.0002}, nil, 0, false, http.StatusOK},
+		{"Pixel Budget Counts GIF Frames", api.Settings{MaxUploadBytes: 32 << 20, MaxConcurrentJobs: 2, MaxConcurrentMegapixels: 0.0002}, threeFrames, 0, false, http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			api.Configure(tc.settings)
+
+			// The first request keeps its admission until it is released.
+			started, release := make(chan struct{}), make(chan struct{})
+			first := api.Admit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				api.ResizeHandler(w, r)
+				close(started)
+				<-release
+			}))
+			done := make(chan struct{})
+			go func() {
+				first.ServeHTTP(httptest.NewRecorder(), newUpload(nil))
+				close(done)
+			}()
+			<-started
+			if tc.releaseEarly {
+				time.AfterFunc(50*time.Millisecond, func() { close(release) })
+			}
+
+			req := newUpload(tc.image)
+			if tc.cancelAfter > 0 {
+				ctx, cancel := context.WithTimeout(req.Context(), tc.cancelAfter)
+				defer cancel()
+				req = req.WithContext(ctx)
+			}
+			recorder := httptest.NewRecorder()
+			api.Admit(http.HandlerFunc(api.ResizeHandler)).ServeHTTP(recorder, req)
+			if !tc.releaseEarly {
+				close(release)
+			}
+			<-done
+
+			if recorder.Code != tc.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d: %s", tc.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+			if tc.expectedStatus == http.StatusServiceUnavailable && recorder.Header().Get("Retry-After") == "" {
+				t.Error("Expected a Retry-After header")
+			}
+		})
+	}
+}
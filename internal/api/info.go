@@ -0,0 +1,401 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf16"
+
+	"go-image-processing-service/internal/logging"
+)
+
+// imageInfo is the JSON document returned by InfoHandler.
+type imageInfo struct {
+	Format      string            `json:"format"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	ColorModel  string            `json:"color_model"`
+	BitDepth    int               `json:"bit_depth"`
+	HasAlpha    bool              `json:"has_alpha"`
+	FileSize    int64             `json:"file_size"`
+	Frames      int               `json:"frames"`
+	Orientation int               `json:"orientation,omitempty"`
+	EXIF        map[string]any    `json:"exif,omitempty"`
+	ICC         *iccInfo          `json:"icc,omitempty"`
+	XMP         map[string]string `json:"xmp,omitempty"`
+}
+
+// iccInfo summarizes the header and description of an ICC color profile.
+type iccInfo struct {
+	Size        int    `json:"size"`
+	Version     string `json:"version"`
+	DeviceClass string `json:"device_class"`
+	ColorSpace  string `json:"color_space"`
+	PCS         string `json:"pcs"`
+	Description string `json:"description,omitempty"`
+}
+
+// InfoHandler describes an uploaded image without transforming it.
+//
+// It expects a POST request with an "image" form field and responds with a JSON document
+// containing the format, dimensions, color model, bit depth, alpha presence, file size and
+// frame count, along with any EXIF, ICC and XMP metadata found in the file.
+//
+// Only the image header is decoded (via image.DecodeConfig), so no pixel data is loaded.
+// Dimensions are the stored ones; `orientation` reports the EXIF rotation to apply.
+// `has_alpha` reflects whether the color model carries an alpha channel.
+func InfoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseMultipartForm(settings.MaxUploadBytes); err != nil {
+		httpError(w, fmt.Errorf("Failed to parse multipart form: %w", err), http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("image")
+	if err != nil {
+		http.Error(w, "Could not get uploaded file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Could not read uploaded file", http.StatusInternalServerError)
+		return
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Could not decode image config", "error", err)
+		http.Error(w, fmt.Sprintf("Could not decode image: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	info := imageInfo{
+		Format:     format,
+		Width:      config.Width,
+		Height:     config.Height,
+		ColorModel: colorModelName(config.ColorModel),
+		BitDepth:   bitDepth(data, format, config.ColorModel),
+		HasAlpha:   hasAlpha(config.ColorModel),
+		FileSize:   header.Size,
+		Frames:     frameCount(data, format),
+	}
+
+	meta := extractMetadata(data, format)
+	if meta.exif != nil {
+		if x, err := parseEXIF(meta.exif); err == nil {
+			info.EXIF = x.fields()
+			info.Orientation = x.orientation()
+		}
+	}
+	if meta.icc != nil {
+		info.ICC = parseICC(meta.icc)
+	}
+	if meta.xmp != nil {
+		info.XMP = parseXMP(meta.xmp)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		logging.FromContext(r.Context()).Error("Could not encode image info", "error", err)
+	}
+}
+
+// colorModelName returns a short name for the standard library color models.
+func colorModelName(model color.Model) string {
+	switch model {
+	case color.RGBAModel:
+		return "RGBA"
+	case color.RGBA64Model:
+		return "RGBA64"
+	case color.NRGBAModel:
+		return "NRGBA"
+	case color.NRGBA64Model:
+		return "NRGBA64"
+	case color.AlphaModel:
+		return "Alpha"
+	case color.Alpha16Model:
+		return "Alpha16"
+	case color.GrayModel:
+		return "Gray"
+	case color.Gray16Model:
+		return "Gray16"
+	case color.YCbCrModel:
+		return "YCbCr"
+	case color.NYCbCrAModel:
+		return "NYCbCrA"
+	case color.CMYKModel:
+		return "CMYK"
+	}
+	if _, ok := model.(color.Palette); ok {
+		return "Paletted"
+	}
+	return "Unknown"
+}
+
+// bitDepth returns the number of bits per sample. PNG reports the depth stored in its
+// header; paletted GIFs report the bits needed to index their palette.
+func bitDepth(data []byte, format string, model color.Model) int {
+	// The IHDR chunk always comes first, with the bit depth at a fixed offset.
+	if format == "png" && len(data) > 24 {
+		return int(data[24])
+	}
+
+	switch model {
+	case color.RGBA64Model, color.NRGBA64Model, color.Alpha16Model, color.Gray16Model:
+		return 16
+	}
+	if palette, ok := model.(color.Palette); ok {
+		depth := 1
+		for 1<<depth < len(palette) {
+			depth++
+		}
+		return depth
+	}
+	return 8
+}
+
+// hasAlpha reports whether a color model has an alpha channel. For palettes this is
+// true when at least one entry is not fully opaque.
+func hasAlpha(model color.Model) bool {
+	switch model {
+	case color.RGBAModel, color.RGBA64Model, color.NRGBAModel, color.NRGBA64Model,
+		color.AlphaModel, color.Alpha16Model, color.NYCbCrAModel:
+		return true
+	}
+	if palette, ok := model.(color.Palette); ok {
+		for _, c := range palette {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// frameCount returns the number of frames of an animated GIF or WebP, and 1 otherwise.
+// The containers are scanned without decoding any frame.
+func frameCount(data []byte, format string) int {
+	frames := 0
+	switch format {
+	case "gif":
+		frames = gifFrameCount(data)
+	case "webp":
+		walkRIFFChunks(data, func(fourCC string, _ []byte) bool {
+			if fourCC == "ANMF" {
+				frames++
+			}
+			return true
+		})
+	}
+	if frames == 0 {
+		return 1
+	}
+	return frames
+}
+
+// gifFrameCount counts the image descriptors of a GIF by skipping over its blocks.
+func gifFrameCount(data []byte) int {
+	if len(data) < 13 {
+		return 0
+	}
+
+	pos := 13
+	// Skip the global color table if present.
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << ((flags & 0x07) + 1)
+	}
+
+	// skipSubBlocks advances past a sequence of data sub-blocks.
+	skipSubBlocks := func() bool {
+		for pos < len(data) {
+			size := int(data[pos])
+			pos++
+			if size == 0 {
+				return true
+			}
+			pos += size
+		}
+		return false
+	}
+
+	frames := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // Extension
+			pos += 2
+			if !skipSubBlocks() {
+				return frames
+			}
+		case 0x2C: // Image descriptor
+			if pos+10 > len(data) {
+				return frames
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << ((flags & 0x07) + 1)
+			}
+			pos++ // LZW minimum code size
+			if !skipSubBlocks() {
+				return frames
+			}
+			frames++
+		default: // Trailer or garbage
+			return frames
+		}
+	}
+	return frames
+}
+
+// parseICC reads the header and the description tag of an ICC profile.
+func parseICC(profile []byte) *iccInfo {
+	if len(profile) < 132 {
+		return nil
+	}
+
+	info := &iccInfo{
+		Size:        int(binary.BigEndian.Uint32(profile[0:])),
+		Version:     fmt.Sprintf("%d.%d.%d", profile[8], profile[9]>>4, profile[9]&0x0F),
+		DeviceClass: strings.TrimSpace(string(profile[12:16])),
+		ColorSpace:  strings.TrimSpace(string(profile[16:20])),
+		PCS:         strings.TrimSpace(string(profile[20:24])),
+	}
+
+	tagCount := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < tagCount && 132+(i+1)*12 <= len(profile); i++ {
+		entry := profile[132+i*12:]
+		if string(entry[:4]) != "desc" {
+			continue
+		}
+		offset := int(binary.BigEndian.Uint32(entry[4:]))
+		size := int(binary.BigEndian.Uint32(entry[8:]))
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			break
+		}
+		info.Description = iccText(profile[offset : offset+size])
+		break
+	}
+
+	return info
+}
+
+// iccText decodes the first string of an ICC 'desc' (v2) or 'mluc' (v4) tag.
+func iccText(tag []byte) string {
+	if len(tag) < 12 {
+		return ""
+	}
+
+	switch string(tag[:4]) {
+	case "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if n <= 0 || 12+n > len(tag) {
+			return ""
+		}
+		return strings.TrimRight(string(tag[12:12+n]), "\x00")
+	case "mluc":
+		if len(tag) < 28 || binary.BigEndian.Uint32(tag[8:]) == 0 {
+			return ""
+		}
+		length := int(binary.BigEndian.Uint32(tag[20:]))
+		offset := int(binary.BigEndian.Uint32(tag[24:]))
+		if length < 0 || offset < 0 || offset+length > len(tag) {
+			return ""
+		}
+		units := make([]uint16, length/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(tag[offset+i*2:])
+		}
+		return string(utf16.Decode(units))
+	}
+	return ""
+}
+
+// parseXMP flattens the properties of the rdf:Description elements of an XMP packet
+// into "prefix:name" keys. Simple values and attributes are kept as-is; the items of
+// rdf:Alt, rdf:Bag and rdf:Seq containers are joined with "; ".
+func parseXMP(packet []byte) map[string]string {
+	const rdfNS = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+
+	decoder := xml.NewDecoder(bytes.NewReader(packet))
+	prefixes := map[string]string{}
+	fields := map[string]string{}
+
+	// qualify turns a namespace URL into the prefix declared for it.
+	qualify := func(name xml.Name) string {
+		if prefix, ok := prefixes[name.Space]; ok {
+			return prefix + ":" + name.Local
+		}
+		return name.Local
+	}
+
+	var property string // property currently being read, if any
+	var items []string  // collected rdf:li values of property
+	var text strings.Builder
+	depth, descriptionDepth := 0, 0
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" {
+					prefixes[attr.Value] = attr.Name.Local
+				}
+			}
+			switch {
+			case t.Name.Space == rdfNS && t.Name.Local == "Description":
+				descriptionDepth = depth
+				for _, attr := range t.Attr {
+					if attr.Name.Space != "xmlns" && attr.Name.Space != rdfNS && attr.Name.Space != "" {
+						fields[qualify(attr.Name)] = attr.Value
+					}
+				}
+			case descriptionDepth > 0 && depth == descriptionDepth+1:
+				property = qualify(t.Name)
+				items = nil
+			}
+			text.Reset()
+
+		case xml.CharData:
+			text.Write(t)
+
+		case xml.EndElement:
+			value := strings.TrimSpace(text.String())
+			text.Reset()
+			switch {
+			case depth == descriptionDepth:
+				descriptionDepth = 0
+			case property != "" && depth == descriptionDepth+1:
+				if len(items) > 0 {
+					fields[property] = strings.Join(items, "; ")
+				} else if value != "" {
+					fields[property] = value
+				}
+				property = ""
+			case property != "" && t.Name.Space == rdfNS && t.Name.Local == "li" && value != "":
+				items = append(items, value)
+			}
+			depth--
+		}
+	}
+
+	return fields
+}
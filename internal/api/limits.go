@@ -0,0 +1,108 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/disintegration/gift"
+)
+
+// maxOutputDimension caps a requested output width or height regardless of the
+// configured limits, keeping size computations far from integer overflow.
+const maxOutputDimension = 1 << 16
+
+// imageLimitError reports an image, uploaded or requested, whose dimensions exceed the
+// configured limits. It is written as a 413 response with a JSON body.
+type imageLimitError struct {
+	Code          string  `json:"code"`
+	Message       string  `json:"error"`
+	Width         int     `json:"width"`
+	Height        int     `json:"height"`
+	Frames        int     `json:"frames,omitempty"`
+	MaxWidth      int     `json:"max_width,omitempty"`
+	MaxHeight     int     `json:"max_height,omitempty"`
+	MaxMegapixels float64 `json:"max_megapixels,omitempty"`
+}
+
+func (e *imageLimitError) Error() string {
+	return e.Message
+}
+
+// checkDimensions returns an *imageLimitError if a width x height image of the given
+// number of frames exceeds the configured MaxWidth, MaxHeight or MaxMegapixels. Every
+// frame of an animation is decoded and processed, so MaxMegapixels bounds the pixels of
+// all frames together. subject names the image in the message, e.g. "image" or "output".
+func checkDimensions(subject string, width, height, frames int) error {
+	frames = max(1, frames)
+	megapixels := float64(width) * float64(height) * float64(frames) / 1e6
+
+	var message string
+	switch {
+	case settings.MaxWidth > 0 && width > settings.MaxWidth:
+		message = fmt.Sprintf("%s is %d pixels wide, more than the allowed %d", subject, width, settings.MaxWidth)
+	case settings.MaxHeight > 0 && height > settings.MaxHeight:
+		message = fmt.Sprintf("%s is %d pixels high, more than the allowed %d", subject, height, settings.MaxHeight)
+	case settings.MaxMegapixels > 0 && megapixels > settings.MaxMegapixels && frames > 1:
+		message = fmt.Sprintf("%s is %.1f megapixels over %d frames, more than the allowed %g", subject, megapixels, frames, settings.MaxMegapixels)
+	case settings.MaxMegapixels > 0 && megapixels > settings.MaxMegapixels:
+		message = fmt.Sprintf("%s is %.1f megapixels, more than the allowed %g", subject, megapixels, settings.MaxMegapixels)
+	default:
+		return nil
+	}
+
+	return &imageLimitError{
+		Code:          "image_too_large",
+		Message:       message,
+		Width:         width,
+		Height:        height,
+		Frames:        frames,
+		MaxWidth:      settings.MaxWidth,
+		MaxHeight:     settings.MaxHeight,
+		MaxMegapixels: settings.MaxMegapixels,
+	}
+}
+
+// checkOutput checks the size filters produce from an image of the given bounds and
+// number of frames against the configured limits.
+func checkOutput(bounds image.Rectangle, frames int, filters ...gift.Filter) error {
+	for _, filter := range filters {
+		bounds = filter.Bounds(bounds)
+	}
+	return checkDimensions("output", bounds.Dx(), bounds.Dy(), frames)
+}
+
+// httpError writes err as an error response with the given status, except for image
+// limit errors, which are written as 413 with a JSON body describing the limits, request
+// bodies cut off by http.MaxBytesReader, which are written as 413, and admission
+// failures, which are written as 503 with a Retry-After header.
+func httpError(w http.ResponseWriter, err error, status int) {
+	var bodyErr *http.MaxBytesError
+	if errors.As(err, &bodyErr) {
+		http.Error(w, fmt.Sprintf("request body is larger than the allowed %d bytes", bodyErr.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if errors.Is(err, errOverloaded) {
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(settings.QueueTimeout.Seconds())))))
+		http.Error(w, errOverloaded.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	var limitErr *imageLimitError
+	if !errors.As(err, &limitErr) {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	body := *limitErr
+	body.Message = err.Error()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(body)
+}
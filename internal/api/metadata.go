@@ -0,0 +1,465 @@
+package api
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"regexp"
+	"sort"
+)
+
+// Values of the `metadata` parameter.
+const (
+	// metadataKeep copies EXIF, ICC and XMP from the source into the output.
+	metadataKeep = "keep"
+	// metadataStrip drops all metadata. This is the default.
+	metadataStrip = "strip"
+	// metadataStripGPS copies all metadata except the EXIF GPS block and the GPS
+	// properties of the XMP packet.
+	metadataStripGPS = "strip-gps"
+)
+
+// Identifiers of metadata payloads inside the supported containers.
+var (
+	jpegXMPHeader = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	jpegICCHeader = []byte("ICC_PROFILE\x00")
+	pngSignature  = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// pngXMPKeyword is the iTXt keyword under which PNG files store XMP packets.
+const pngXMPKeyword = "XML:com.adobe.xmp"
+
+// XMP GPS properties, such as exif:GPSLatitude, written as attributes of an
+// rdf:Description or as elements, empty or with content.
+var (
+	xmpGPSAttribute = regexp.MustCompile(`\s[\w.-]+:GPS[\w.-]*\s*=\s*("[^"]*"|'[^']*')`)
+	xmpGPSElement   = regexp.MustCompile(`(?s)<[\w.-]+:GPS[\w.-]*(\s[^>]*?)?(/>|>.*?</[\w.-]+:GPS[\w.-]*\s*>)`)
+	xmpGPSName      = regexp.MustCompile(`:GPS`)
+)
+
+// maxMetadataSize bounds decompressed metadata payloads, e.g. zlib-compressed ICC profiles.
+const maxMetadataSize = 4 << 20
+
+// maxJPEGSegmentPayload is the largest payload a JPEG marker segment can hold.
+const maxJPEGSegmentPayload = 0xFFFF - 2
+
+// imageMetadata holds the raw metadata payloads found in an encoded image.
+type imageMetadata struct {
+	// exif is the TIFF structure of the EXIF block, without any container header.
+	exif []byte
+	// icc is the complete ICC color profile.
+	icc []byte
+	// xmp is the XMP packet, usually an RDF/XML document.
+	xmp []byte
+}
+
+// empty reports whether m carries no metadata at all.
+func (m imageMetadata) empty() bool {
+	return m.exif == nil && m.icc == nil && m.xmp == nil
+}
+
+// selected returns the metadata to copy into the output for the given mode.
+//
+// When the EXIF orientation has already been applied to the pixels, the copied
+// Orientation tag is reset so viewers do not rotate the image a second time.
+// In strip-gps mode, EXIF that cannot be parsed, and XMP whose GPS properties cannot
+// all be removed, are dropped rather than risk leaking a location.
+func (m imageMetadata) selected(mode string, autorotated bool) imageMetadata {
+	switch mode {
+	case metadataKeep, metadataStripGPS:
+	default:
+		return imageMetadata{}
+	}
+
+	out := m
+	if m.exif != nil && (autorotated || mode == metadataStripGPS) {
+		exif, err := rewriteEXIF(m.exif, autorotated, mode == metadataStripGPS)
+		switch {
+		case err == nil:
+			out.exif = exif
+		case mode == metadataStripGPS:
+			out.exif = nil
+		}
+	}
+	if m.xmp != nil && mode == metadataStripGPS {
+		out.xmp = stripXMPGPS(m.xmp)
+	}
+	return out
+}
+
+// stripXMPGPS returns a copy of an XMP packet without its GPS properties, or nil if
+// any remain after removing those in the usual attribute and element forms.
+func stripXMPGPS(xmp []byte) []byte {
+	out := xmpGPSAttribute.ReplaceAll(xmp, nil)
+	out = xmpGPSElement.ReplaceAll(out, nil)
+	if xmpGPSName.Match(out) {
+		return nil
+	}
+	return out
+}
+
+// extractMetadata collects the EXIF, ICC and XMP payloads of an encoded image.
+// Unknown formats and malformed containers yield whatever could be read.
+func extractMetadata(data []byte, format string) imageMetadata {
+	var meta imageMetadata
+
+	switch format {
+	case "jpeg":
+		// ICC profiles may be split over several APP2 segments, each carrying
+		// its sequence number, so collect them before joining.
+		iccChunks := map[byte][]byte{}
+		walkJPEGSegments(data, func(marker byte, payload []byte) bool {
+			switch {
+			case marker == 0xE1 && bytes.HasPrefix(payload, exifHeader) && meta.exif == nil:
+				meta.exif = payload[len(exifHeader):]
+			case marker == 0xE1 && bytes.HasPrefix(payload, jpegXMPHeader) && meta.xmp == nil:
+				meta.xmp = payload[len(jpegXMPHeader):]
+			case marker == 0xE2 && bytes.HasPrefix(payload, jpegICCHeader) && len(payload) > len(jpegICCHeader)+2:
+				seq := payload[len(jpegICCHeader)]
+				iccChunks[seq] = payload[len(jpegICCHeader)+2:]
+			}
+			return true
+		})
+		if len(iccChunks) > 0 {
+			seqs := make([]int, 0, len(iccChunks))
+			for seq := range iccChunks {
+				seqs = append(seqs, int(seq))
+			}
+			sort.Ints(seqs)
+			for _, seq := range seqs {
+				meta.icc = append(meta.icc, iccChunks[byte(seq)]...)
+			}
+		}
+
+	case "png":
+		walkPNGChunks(data, func(typ string, payload []byte) bool {
+			switch typ {
+			case "eXIf":
+				meta.exif = payload
+			case "iCCP":
+				// Profile name, a null separator and the compression method precede the profile.
+				if i := bytes.IndexByte(payload, 0); i >= 0 && i+2 <= len(payload) {
+					meta.icc = inflate(payload[i+2:])
+				}
+			case "iTXt":
+				if keyword, text, ok := parsePNGITXt(payload); ok && keyword == pngXMPKeyword {
+					meta.xmp = text
+				}
+			}
+			return true
+		})
+
+	case "webp":
+		walkRIFFChunks(data, func(fourCC string, payload []byte) bool {
+			switch fourCC {
+			case "EXIF":
+				// Some writers keep the JPEG-style header in front of the TIFF data.
+				meta.exif = bytes.TrimPrefix(payload, exifHeader)
+			case "ICCP":
+				meta.icc = payload
+			case "XMP ":
+				meta.xmp = payload
+			}
+			return true
+		})
+	}
+
+	return meta
+}
+
+// walkJPEGSegments calls fn with the marker and payload of every segment preceding
+// the image data of a JPEG. Iteration stops when fn returns false.
+func walkJPEGSegments(data []byte, fn func(marker byte, payload []byte) bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return
+	}
+
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return
+		}
+		marker := data[pos+1]
+		// Fill bytes and markers without a length field.
+		if marker == 0xFF {
+			pos++
+			continue
+		}
+		if marker == 0xD8 || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			pos += 2
+			continue
+		}
+		// Start of scan or end of image: no metadata segments follow.
+		if marker == 0xDA || marker == 0xD9 {
+			return
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return
+		}
+
+		if !fn(marker, data[pos+4:end]) {
+			return
+		}
+		pos = end
+	}
+}
+
+// walkPNGChunks calls fn with the type and data of every chunk of a PNG.
+// Iteration stops when fn returns false.
+func walkPNGChunks(data []byte, fn func(typ string, payload []byte) bool) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return
+	}
+
+	for pos := len(pngSignature); pos+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		typ := string(data[pos+4 : pos+8])
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return
+		}
+		if !fn(typ, data[pos+8:pos+8+length]) || typ == "IEND" {
+			return
+		}
+		pos = end
+	}
+}
+
+// walkRIFFChunks calls fn with the FourCC and payload of every top-level chunk of a
+// RIFF WEBP file. Iteration stops when fn returns false.
+func walkRIFFChunks(data []byte, fn func(fourCC string, payload []byte) bool) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return
+	}
+
+	for pos := 12; pos+8 <= len(data); {
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size
+		if size < 0 || end > len(data) {
+			return
+		}
+		if !fn(fourCC, data[pos+8:end]) {
+			return
+		}
+		// Chunks are padded to an even size.
+		pos = end + size%2
+	}
+}
+
+// parsePNGITXt splits an iTXt chunk into its keyword and (decompressed) text.
+func parsePNGITXt(payload []byte) (string, []byte, bool) {
+	keyword, rest, ok := bytes.Cut(payload, []byte{0})
+	if !ok || len(rest) < 2 {
+		return "", nil, false
+	}
+	compressed := rest[0] == 1
+	rest = rest[2:]
+
+	// Skip the language tag and the translated keyword.
+	for i := 0; i < 2; i++ {
+		_, rest, ok = bytes.Cut(rest, []byte{0})
+		if !ok {
+			return "", nil, false
+		}
+	}
+
+	if compressed {
+		rest = inflate(rest)
+	}
+	return string(keyword), rest, rest != nil
+}
+
+// inflate decompresses zlib data, returning nil if it is malformed or too large.
+func inflate(data []byte) []byte {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	defer zr.Close()
+
+	out, err := io.ReadAll(io.LimitReader(zr, maxMetadataSize+1))
+	if err != nil || len(out) > maxMetadataSize {
+		return nil
+	}
+	return out
+}
+
+// embedMetadata returns a copy of an encoded image with the given metadata inserted.
+// JPEG, PNG and WebP are supported; other formats, and payloads that do not fit the
+// container, are returned unchanged.
+func embedMetadata(data []byte, format string, meta imageMetadata) []byte {
+	switch format {
+	case "jpeg", "jpg":
+		return embedJPEGMetadata(data, meta)
+	case "png":
+		return embedPNGMetadata(data, meta)
+	case "webp":
+		return embedWebPMetadata(data, meta)
+	}
+	return data
+}
+
+// embedJPEGMetadata inserts APP1 EXIF and XMP segments and APP2 ICC segments after SOI.
+func embedJPEGMetadata(data []byte, meta imageMetadata) []byte {
+	if len(data) < 2 {
+		return data
+	}
+
+	var buf bytes.Buffer
+	buf.Write(data[:2]) // SOI
+
+	writeSegment := func(marker byte, parts ...[]byte) {
+		size := 2
+		for _, part := range parts {
+			size += len(part)
+		}
+		buf.Write([]byte{0xFF, marker, byte(size >> 8), byte(size)})
+		for _, part := range parts {
+			buf.Write(part)
+		}
+	}
+
+	if meta.exif != nil && len(exifHeader)+len(meta.exif) <= maxJPEGSegmentPayload {
+		writeSegment(0xE1, exifHeader, meta.exif)
+	}
+	if meta.xmp != nil && len(jpegXMPHeader)+len(meta.xmp) <= maxJPEGSegmentPayload {
+		writeSegment(0xE1, jpegXMPHeader, meta.xmp)
+	}
+	if meta.icc != nil {
+		// Each chunk carries the header, its 1-based sequence number and the chunk count.
+		chunkSize := maxJPEGSegmentPayload - len(jpegICCHeader) - 2
+		count := (len(meta.icc) + chunkSize - 1) / chunkSize
+		if count <= 255 {
+			for i := 0; i < count; i++ {
+				chunk := meta.icc[i*chunkSize : min((i+1)*chunkSize, len(meta.icc))]
+				writeSegment(0xE2, jpegICCHeader, []byte{byte(i + 1), byte(count)}, chunk)
+			}
+		}
+	}
+
+	buf.Write(data[2:])
+	return buf.Bytes()
+}
+
+// embedPNGMetadata inserts iCCP, eXIf and iTXt chunks right after IHDR, which keeps
+// them ahead of PLTE and IDAT as the PNG specification requires.
+func embedPNGMetadata(data []byte, meta imageMetadata) []byte {
+	// Signature plus the 13-byte IHDR chunk with its length, type and CRC.
+	const ihdrEnd = 8 + 4 + 4 + 13 + 4
+	if len(data) < ihdrEnd || !bytes.HasPrefix(data, pngSignature) {
+		return data
+	}
+
+	var buf bytes.Buffer
+	buf.Write(data[:ihdrEnd])
+
+	writeChunk := func(typ string, payload []byte) {
+		binary.Write(&buf, binary.BigEndian, uint32(len(payload)))
+		crc := crc32.NewIEEE()
+		crc.Write([]byte(typ))
+		crc.Write(payload)
+		buf.WriteString(typ)
+		buf.Write(payload)
+		binary.Write(&buf, binary.BigEndian, crc.Sum32())
+	}
+
+	if meta.icc != nil {
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		zw.Write(meta.icc)
+		zw.Close()
+		// Profile name, null separator and compression method 0 (zlib).
+		writeChunk("iCCP", append([]byte("ICC profile\x00\x00"), compressed.Bytes()...))
+	}
+	if meta.exif != nil {
+		writeChunk("eXIf", meta.exif)
+	}
+	if meta.xmp != nil {
+		// Keyword, then uncompressed flag, method, empty language tag and translated keyword.
+		payload := append([]byte(pngXMPKeyword), 0, 0, 0, 0, 0)
+		writeChunk("iTXt", append(payload, meta.xmp...))
+	}
+
+	buf.Write(data[ihdrEnd:])
+	return buf.Bytes()
+}
+
+// embedWebPMetadata converts a simple (VP8L) WebP into the extended format with a
+// VP8X header so that ICCP, EXIF and XMP chunks can be added.
+func embedWebPMetadata(data []byte, meta imageMetadata) []byte {
+	var bitstream []byte
+	walkRIFFChunks(data, func(fourCC string, payload []byte) bool {
+		if fourCC == "VP8L" {
+			bitstream = payload
+		}
+		return bitstream == nil
+	})
+	// The VP8L header is a signature byte followed by 14-bit width and height minus one
+	// and an alpha hint bit.
+	if len(bitstream) < 5 || bitstream[0] != 0x2F {
+		return data
+	}
+	bits := binary.LittleEndian.Uint32(bitstream[1:])
+	width := bits&0x3FFF + 1
+	height := (bits>>14)&0x3FFF + 1
+
+	var flags byte
+	if bits>>28&1 == 1 {
+		flags |= 0x10
+	}
+	if meta.icc != nil {
+		flags |= 0x20
+	}
+	if meta.exif != nil {
+		flags |= 0x08
+	}
+	if meta.xmp != nil {
+		flags |= 0x04
+	}
+
+	vp8x := make([]byte, 10)
+	vp8x[0] = flags
+	putUint24LE(vp8x[4:], width-1)
+	putUint24LE(vp8x[7:], height-1)
+
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	writeChunk := func(fourCC string, payload []byte) {
+		body.WriteString(fourCC)
+		binary.Write(&body, binary.LittleEndian, uint32(len(payload)))
+		body.Write(payload)
+		if len(payload)%2 == 1 {
+			body.WriteByte(0)
+		}
+	}
+
+	writeChunk("VP8X", vp8x)
+	if meta.icc != nil {
+		writeChunk("ICCP", meta.icc)
+	}
+	writeChunk("VP8L", bitstream)
+	if meta.exif != nil {
+		writeChunk("EXIF", meta.exif)
+	}
+	if meta.xmp != nil {
+		writeChunk("XMP ", meta.xmp)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	binary.Write(&out, binary.LittleEndian, uint32(body.Len()))
+	out.Write(body.Bytes())
+	return out.Bytes()
+}
+
+// putUint24LE stores the low 24 bits of v in b in little-endian order.
+func putUint24LE(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errNotAcceptable is returned by outputFormat when the Accept header rules out
+// every format the service can produce.
+var errNotAcceptable = errors.New("none of the accepted media types can be produced. Supported: image/jpeg, image/png, image/webp, image/gif")
+
+// formatMediaTypes maps output format names to their media types, in the order
+// used to break ties during content negotiation.
+var formatMediaTypes = []struct {
+	format    string
+	mediaType string
+}{
+	{"jpeg", "image/jpeg"},
+	{"png", "image/png"},
+	{"webp", "image/webp"},
+	{"gif", "image/gif"},
+}
+
+// outputFormat decides which format a transformed image is returned in.
+//
+// An explicit `format` query parameter always wins. Otherwise the Accept header is
+// consulted, preferring the source format whenever it is acceptable so that, for
+// example, a transparent PNG stays a PNG. Without either, the source format is used.
+func outputFormat(r *http.Request, src *decodedImage) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if !isSupportedFormat(format) {
+			return "", errors.New("invalid 'format' parameter. Supported formats: jpeg, png, webp, gif")
+		}
+		return format, nil
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return src.format, nil
+	}
+
+	ranges := parseAccept(accept)
+
+	best, bestQ := "", 0.0
+	if q := acceptQuality(ranges, mediaTypeOf(src.format)); q > 0 {
+		best, bestQ = src.format, q
+	}
+	for _, candidate := range formatMediaTypes {
+		if q := acceptQuality(ranges, candidate.mediaType); q > bestQ {
+			best, bestQ = candidate.format, q
+		}
+	}
+
+	if best == "" {
+		return "", errNotAcceptable
+	}
+	return best, nil
+}
+
+// outputFormatStatus returns the HTTP status matching an outputFormat error.
+func outputFormatStatus(err error) int {
+	if errors.Is(err, errNotAcceptable) {
+		return http.StatusNotAcceptable
+	}
+	return http.StatusBadRequest
+}
+
+// mediaTypeOf returns the media type for a format name, or "" if it is unknown.
+func mediaTypeOf(format string) string {
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	for _, candidate := range formatMediaTypes {
+		if candidate.format == format {
+			return candidate.mediaType
+		}
+	}
+	return ""
+}
+
+// acceptRange is one media range of an Accept header with its quality value.
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept splits an Accept header into media ranges. Ranges without a
+// q parameter default to 1; malformed q values are treated as 0.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		if mediaType == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(key, "q") {
+				parsed, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+
+		ranges = append(ranges, acceptRange{mediaType: mediaType, q: q})
+	}
+	return ranges
+}
+
+// acceptQuality returns the quality the Accept ranges give to mediaType,
+// using the most specific matching range.
+func acceptQuality(ranges []acceptRange, mediaType string) float64 {
+	if mediaType == "" {
+		return 0
+	}
+
+	typ, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, -1
+	for _, rng := range ranges {
+		var s int
+		switch rng.mediaType {
+		case mediaType:
+			s = 2
+		case typ + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s > specificity {
+			q, specificity = rng.q, s
+		}
+	}
+	return q
+}
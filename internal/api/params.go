@@ -0,0 +1,115 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/gift"
+)
+
+// parseHexColor parses a color written as #RRGGBB or #RRGGBBAA (the leading # is
+// optional, since it has to be escaped in URLs).
+func parseHexColor(s string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 && len(hex) != 8 {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q. Use #RRGGBB or #RRGGBBAA", s)
+	}
+
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q. Use #RRGGBB or #RRGGBBAA", s)
+	}
+	if len(hex) == 6 {
+		value = value<<8 | 0xFF
+	}
+
+	return color.NRGBA{
+		R: uint8(value >> 24),
+		G: uint8(value >> 16),
+		B: uint8(value >> 8),
+		A: uint8(value),
+	}, nil
+}
+
+// colorParam reads an optional color parameter, returning def when it is absent.
+func colorParam(value string, def color.Color) (color.Color, error) {
+	if value == "" {
+		return def, nil
+	}
+	return parseHexColor(value)
+}
+
+// boolParam reads an optional true/false parameter, returning def when it is absent.
+func boolParam(params url.Values, name string, def bool) (bool, error) {
+	v := params.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid '%s' parameter. Must be true or false", name)
+	}
+	return b, nil
+}
+
+// parseInterpolation maps the `interpolation` parameter to a gift interpolation,
+// defaulting to cubic.
+func parseInterpolation(s string) (gift.Interpolation, error) {
+	switch s {
+	case "nearest":
+		return gift.NearestNeighborInterpolation, nil
+	case "linear":
+		return gift.LinearInterpolation, nil
+	case "cubic", "":
+		return gift.CubicInterpolation, nil
+	}
+	return 0, errors.New("invalid 'interpolation' parameter. Supported: nearest, linear, cubic")
+}
+
+// parseResampling maps the `filter` parameter to a gift resampling, defaulting to lanczos.
+func parseResampling(s string) (gift.Resampling, error) {
+	switch s {
+	case "nearest":
+		return gift.NearestNeighborResampling, nil
+	case "box":
+		return gift.BoxResampling, nil
+	case "linear":
+		return gift.LinearResampling, nil
+	case "cubic":
+		return gift.CubicResampling, nil
+	case "lanczos", "":
+		return gift.LanczosResampling, nil
+	}
+	return nil, errors.New("invalid 'filter' parameter. Supported: nearest, box, linear, cubic, lanczos")
+}
+
+// parseGravity maps a `gravity` parameter to a gift anchor. Both compass names
+// (north, southeast, ...) and edge names (top, bottom-right, ...) are accepted;
+// an empty value means center.
+func parseGravity(s string) (gift.Anchor, error) {
+	switch strings.ToLower(s) {
+	case "", "center", "centre":
+		return gift.CenterAnchor, nil
+	case "north", "top":
+		return gift.TopAnchor, nil
+	case "south", "bottom":
+		return gift.BottomAnchor, nil
+	case "east", "right":
+		return gift.RightAnchor, nil
+	case "west", "left":
+		return gift.LeftAnchor, nil
+	case "northeast", "top-right":
+		return gift.TopRightAnchor, nil
+	case "northwest", "top-left":
+		return gift.TopLeftAnchor, nil
+	case "southeast", "bottom-right":
+		return gift.BottomRightAnchor, nil
+	case "southwest", "bottom-left":
+		return gift.BottomLeftAnchor, nil
+	}
+	return 0, fmt.Errorf("invalid 'gravity' parameter %q. Supported: center, north, south, east, west, northeast, northwest, southeast, southwest", s)
+}
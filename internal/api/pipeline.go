@@ -0,0 +1,309 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/gift"
+
+	"go-image-processing-service/internal/logging"
+)
+
+// maxPipelineSteps caps the number of operations a single /process request may chain.
+const maxPipelineSteps = 32
+
+// pipelineStep is a single parsed operation of a /process request.
+type pipelineStep struct {
+	op     string
+	params url.Values
+}
+
+// pipelineOp describes how a named pipeline operation is turned into a gift filter.
+type pipelineOp struct {
+	// args names the parameters filled, in order, by positional arguments
+	// in the compact syntax (e.g. "crop:10,10,200,200").
+	args []string
+	// build creates the filter from the named parameters. It accepts the same
+	// parameters as the query string of the matching single-purpose handler.
+	// A nil filter means the step is a no-op (e.g. "grayscale:false").
+	build func(params url.Values) (gift.Filter, error)
+}
+
+// resizeDimensions matches the WIDTHxHEIGHT argument of a compact resize step, either
+// side of which may be empty.
+var resizeDimensions = regexp.MustCompile(`^\d*x\d*$`)
+
+// pipelineOps lists the filter operations available to ProcessHandler.
+// The "format", "quality" and "metadata" steps are handled separately since
+// they only affect the final encode.
+var pipelineOps = map[string]pipelineOp{
+	"resize": {args: []string{"width", "height"}, build: resizeFilter},
+	"crop":   {args: []string{"x", "y", "width", "height"}, build: cropFilter},
+	"rotate": {args: []string{"angle"}, build: rotateFilter},
+	"flip":   {args: []string{"direction"}, build: flipFilter},
+
+	// Convolutions, also available through BlurHandler and SharpenHandler.
+	"blur":    {args: []string{"sigma"}, build: blurFilter},
+	"sharpen": {args: []string{"sigma", "amount", "threshold"}, build: sharpenFilter},
+
+	// Text watermark, also available through WatermarkHandler.
+	"text": {args: []string{"text", "size", "color"}, build: textFilter},
+
+	// Color adjustments, also available together through AdjustHandler.
+	"gamma":      {args: []string{"gamma"}, build: gammaFilter},
+	"brightness": {args: []string{"brightness"}, build: brightnessFilter},
+	"contrast":   {args: []string{"contrast"}, build: contrastFilter},
+	"saturation": {args: []string{"saturation"}, build: saturationFilter},
+	"hue":        {args: []string{"hue"}, build: hueFilter},
+	"colorize":   {args: []string{"colorize", "colorizeSaturation", "colorizeAmount"}, build: colorizeFilter},
+	"grayscale":  {args: []string{"grayscale"}, build: grayscaleFilter},
+	"sepia":      {args: []string{"sepia"}, build: sepiaFilter},
+	"invert":     {args: []string{"invert"}, build: invertFilter},
+}
+
+// ProcessHandler applies an ordered list of operations to an uploaded image in one pass.
+//
+// It expects a POST request with an "image" form field and an `ops` parameter, given either
+// as a query parameter or as a form field. The image is decoded once, every operation is
+// applied through a single gift filter chain, and the result is encoded once at the end.
+//
+// `ops` accepts two syntaxes:
+//   - compact: `crop:10,10,200,200|resize:300x0|rotate:90|format:png`, where arguments are
+//     positional or `name=value` pairs (e.g. `resize:width=300`).
+//   - JSON: `[{"op":"crop","x":10,"y":10,"width":200,"height":200},{"op":"format","format":"png"}]`.
+//
+// Supported operations are resize, crop, rotate, flip, blur, sharpen and text, and the color adjustments of
+// AdjustHandler (gamma, brightness, contrast, saturation, hue, colorize, grayscale, sepia and
+// invert), taking the same parameters as the corresponding endpoints, plus `format` (jpeg, png, webp, gif; with an optional `lossless` flag
+// for WebP), `quality` (1-100) and `metadata` (keep, strip, strip-gps) for the output.
+// Without a format step the output format is negotiated as for the other handlers, defaulting
+// to the source format. Animated GIFs are processed frame by frame when the output is GIF.
+// Steps that would grow the image beyond the configured pixel limits are rejected with 413.
+// A resize step with `crop=auto` reports its window in the X-Crop-Rect header, in the
+// pixels of the image the step receives.
+func ProcessHandler(w http.ResponseWriter, r *http.Request) {
+	src, err := decodeImageFromRequest(r)
+	if err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	steps, err := parsePipeline(r.FormValue("ops"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// output collects the parameters of the output steps for the final encode.
+	output := url.Values{}
+	var filters []gift.Filter
+	// bounds tracks the image size through the chain so steps can be checked against it.
+	bounds := src.image.Bounds()
+
+	for i, step := range steps {
+		switch step.op {
+		case "format":
+			format := step.params.Get("format")
+			if !isSupportedFormat(format) {
+				http.Error(w, fmt.Sprintf("step %d (format): unsupported format %q", i+1, format), http.StatusBadRequest)
+				return
+			}
+			output.Set("format", format)
+			if lossless := step.params.Get("lossless"); lossless != "" {
+				output.Set("lossless", lossless)
+			}
+		case "metadata":
+			mode := step.params.Get("metadata")
+			if mode != metadataKeep && mode != metadataStrip && mode != metadataStripGPS {
+				http.Error(w, fmt.Sprintf("step %d (metadata): must be one of keep, strip, strip-gps", i+1), http.StatusBadRequest)
+				return
+			}
+			output.Set("metadata", mode)
+		case "quality":
+			quality, err := strconv.Atoi(step.params.Get("quality"))
+			if err != nil || quality < 1 || quality > 100 {
+				http.Error(w, fmt.Sprintf("step %d (quality): must be an integer between 1 and 100", i+1), http.StatusBadRequest)
+				return
+			}
+			output.Set("quality", step.params.Get("quality"))
+		default:
+			filter, err := pipelineOps[step.op].build(step.params)
+			if err != nil {
+				httpError(w, fmt.Errorf("step %d (%s): %w", i+1, step.op, err), http.StatusBadRequest)
+				return
+			}
+			if filter == nil {
+				continue
+			}
+			if err := validateBounds(filter, bounds); err != nil {
+				http.Error(w, fmt.Sprintf("step %d (%s): %v", i+1, step.op, err), http.StatusBadRequest)
+				return
+			}
+			bounds = filter.Bounds(bounds)
+			if err := checkDimensions("output", bounds.Dx(), bounds.Dy(), src.frames()); err != nil {
+				httpError(w, fmt.Errorf("step %d (%s): %w", i+1, step.op, err), http.StatusBadRequest)
+				return
+			}
+			if smartCrop, ok := filter.(smartCropFilter); ok {
+				// Locate the window once, on the image as the earlier steps leave it, so
+				// that every frame of an animation is cropped the same way.
+				smartCrop = smartCrop.locate(applyFilters(src.image, filters...))
+				w.Header().Set(smartCropHeader, formatRect(smartCrop.rect))
+				logging.AddFields(r.Context(), "crop_rect", formatRect(smartCrop.rect))
+				filter = smartCrop
+			}
+			filters = append(filters, filter)
+		}
+	}
+
+	format := output.Get("format")
+	if format == "" {
+		format, err = outputFormat(r, src)
+		if err != nil {
+			http.Error(w, err.Error(), outputFormatStatus(err))
+			return
+		}
+		w.Header().Add("Vary", "Accept")
+	}
+
+	logging.FromContext(r.Context()).Debug("Processing pipeline", "steps", len(steps), "output_format", format)
+
+	dst := transformImage(src, format, filters...)
+
+	if err := writeImage(w, dst, format, encodeOptionsFromParams(output)); err != nil {
+		logging.FromContext(r.Context()).Error("Could not encode processed image", "error", err)
+		http.Error(w, "Could not encode processed image", http.StatusInternalServerError)
+	}
+}
+
+// parsePipeline parses the `ops` parameter in either its JSON or compact form
+// and validates that every step names a known operation.
+func parsePipeline(raw string) ([]pipelineStep, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, errors.New("missing 'ops' parameter")
+	}
+
+	var steps []pipelineStep
+	var err error
+	if strings.HasPrefix(raw, "[") {
+		steps, err = parseJSONPipeline(raw)
+	} else {
+		steps, err = parseCompactPipeline(raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(steps) > maxPipelineSteps {
+		return nil, fmt.Errorf("too many operations: %d (max %d)", len(steps), maxPipelineSteps)
+	}
+
+	for i, step := range steps {
+		if step.op == "format" || step.op == "quality" || step.op == "metadata" {
+			continue
+		}
+		if _, ok := pipelineOps[step.op]; !ok {
+			return nil, fmt.Errorf("step %d: unknown operation %q", i+1, step.op)
+		}
+	}
+
+	return steps, nil
+}
+
+// parseCompactPipeline parses the `op:arg,arg|op:arg` syntax.
+func parseCompactPipeline(raw string) ([]pipelineStep, error) {
+	var steps []pipelineStep
+
+	for i, part := range strings.Split(raw, "|") {
+		name, argStr, _ := strings.Cut(strings.TrimSpace(part), ":")
+		if name == "" {
+			return nil, fmt.Errorf("step %d: missing operation name", i+1)
+		}
+
+		var args []string
+		if argStr != "" {
+			args = strings.Split(argStr, ",")
+		}
+
+		// Resize dimensions are conventionally written as WIDTHxHEIGHT.
+		if name == "resize" && len(args) == 1 && resizeDimensions.MatchString(strings.TrimSpace(args[0])) {
+			args = strings.SplitN(args[0], "x", 2)
+		}
+
+		positional := positionalArgs(name)
+		params := url.Values{}
+		for j, arg := range args {
+			arg = strings.TrimSpace(arg)
+			if key, value, ok := strings.Cut(arg, "="); ok {
+				params.Set(key, value)
+				continue
+			}
+			if j >= len(positional) {
+				return nil, fmt.Errorf("step %d (%s): too many arguments", i+1, name)
+			}
+			params.Set(positional[j], arg)
+		}
+
+		steps = append(steps, pipelineStep{op: name, params: params})
+	}
+
+	return steps, nil
+}
+
+// parseJSONPipeline parses a JSON array of objects, each with an "op" field and
+// the operation's parameters as sibling fields.
+func parseJSONPipeline(raw string) ([]pipelineStep, error) {
+	var objects []map[string]any
+	if err := json.Unmarshal([]byte(raw), &objects); err != nil {
+		return nil, fmt.Errorf("invalid 'ops' JSON: %v", err)
+	}
+
+	steps := make([]pipelineStep, 0, len(objects))
+	for i, obj := range objects {
+		name, _ := obj["op"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("step %d: missing operation name", i+1)
+		}
+
+		params := url.Values{}
+		for key, value := range obj {
+			if key == "op" {
+				continue
+			}
+			switch v := value.(type) {
+			case string:
+				params.Set(key, v)
+			case float64:
+				params.Set(key, strconv.FormatFloat(v, 'f', -1, 64))
+			case bool:
+				params.Set(key, strconv.FormatBool(v))
+			default:
+				return nil, fmt.Errorf("step %d (%s): unsupported value for %q", i+1, name, key)
+			}
+		}
+
+		steps = append(steps, pipelineStep{op: name, params: params})
+	}
+
+	return steps, nil
+}
+
+// positionalArgs returns the parameter names filled by positional arguments for an operation.
+func positionalArgs(name string) []string {
+	switch name {
+	case "format":
+		return []string{"format"}
+	case "quality":
+		return []string{"quality"}
+	case "metadata":
+		return []string{"metadata"}
+	}
+	return pipelineOps[name].args
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/disintegration/gift"
+)
+
+// Values of the resize `fit` parameter.
+const (
+	// fitFill stretches the image to exactly width x height. This is the default.
+	fitFill = "fill"
+	// fitCover scales the image to cover width x height and crops the overflow.
+	fitCover = "cover"
+	// fitContain scales the image to fit within width x height and pads the rest.
+	fitContain = "contain"
+	// fitInside scales the image to fit within width x height without padding.
+	fitInside = "inside"
+	// fitOutside scales the image so that it covers width x height without cropping.
+	fitOutside = "outside"
+)
+
+// fitFilter resizes an image according to a fit mode. The concrete gift filters depend
+// on the source dimensions, so they are only chosen once the source bounds are known.
+type fitFilter struct {
+	mode          string
+	width, height int
+	resampling    gift.Resampling
+	// preShrink enables the box pre-shrink for large downscales; set for Lanczos.
+	preShrink  bool
+	anchor     gift.Anchor
+	background color.Color
+	// withoutEnlargement caps the scale factor at 1 so the image is never upscaled.
+	withoutEnlargement bool
+	// sharpen applies a mild unsharp mask after downscaling.
+	sharpen bool
+}
+
+// Bounds returns the size of the resized image.
+func (f fitFilter) Bounds(srcBounds image.Rectangle) image.Rectangle {
+	return gift.New(f.filters(srcBounds)...).Bounds(srcBounds)
+}
+
+// Draw resizes src into dst.
+func (f fitFilter) Draw(dst draw.Image, src image.Image, options *gift.Options) {
+	g := gift.New(f.filters(src.Bounds())...)
+	if options != nil {
+		g.Options = *options
+	}
+	g.Draw(dst, src)
+}
+
+// filters returns the gift filters implementing the fit mode for a source of the given size.
+func (f fitFilter) filters(srcBounds image.Rectangle) []gift.Filter {
+	sw, sh := srcBounds.Dx(), srcBounds.Dy()
+	if sw <= 0 || sh <= 0 {
+		return nil
+	}
+
+	// With a single dimension every mode is a proportional resize.
+	width, height := f.width, f.height
+	if width == 0 || height == 0 {
+		scale := float64(width) / float64(sw)
+		if width == 0 {
+			scale = float64(height) / float64(sh)
+		}
+		if f.withoutEnlargement {
+			scale = math.Min(scale, 1)
+		}
+		return f.resize(sw, sh, scaled(sw, scale), scaled(sh, scale))
+	}
+
+	scaleX := float64(width) / float64(sw)
+	scaleY := float64(height) / float64(sh)
+
+	switch f.mode {
+	case fitCover:
+		scale := math.Max(scaleX, scaleY)
+		if f.withoutEnlargement {
+			scale = math.Min(scale, 1)
+		}
+		rw, rh := scaled(sw, scale), scaled(sh, scale)
+		// Crop as much of the target box as the resized image covers.
+		return append(f.resize(sw, sh, rw, rh), gift.CropToSize(min(width, rw), min(height, rh), f.anchor))
+
+	case fitContain:
+		scale := math.Min(scaleX, scaleY)
+		if f.withoutEnlargement {
+			scale = math.Min(scale, 1)
+		}
+		pad := padFilter{width: width, height: height, anchor: f.anchor, background: f.background}
+		return append(f.resize(sw, sh, min(scaled(sw, scale), width), min(scaled(sh, scale), height)), pad)
+
+	case fitInside, fitOutside:
+		scale := math.Min(scaleX, scaleY)
+		if f.mode == fitOutside {
+			scale = math.Max(scaleX, scaleY)
+		}
+		if f.withoutEnlargement {
+			scale = math.Min(scale, 1)
+		}
+		return f.resize(sw, sh, scaled(sw, scale), scaled(sh, scale))
+
+	default: // fitFill
+		if f.withoutEnlargement {
+			width, height = min(width, sw), min(height, sh)
+		}
+		return f.resize(sw, sh, width, height)
+	}
+}
+
+// preShrinkFactor is how many times larger than the target an image must be, in both
+// dimensions, before a Lanczos downscale is preceded by a box pre-shrink.
+const preShrinkFactor = 4
+
+// resize returns the filters scaling a sw x sh image to width x height.
+//
+// Lanczos samples a wide neighbourhood of source pixels for every output pixel, which
+// gets slow for very large downscales. In that case the image is first shrunk with the
+// cheap box filter to twice the target size, and Lanczos only does the final step.
+func (f fitFilter) resize(sw, sh, width, height int) []gift.Filter {
+	if width == sw && height == sh {
+		return nil
+	}
+
+	var filters []gift.Filter
+	if f.preShrink && sw >= width*preShrinkFactor && sh >= height*preShrinkFactor {
+		filters = append(filters, gift.Resize(width*2, height*2, gift.BoxResampling))
+	}
+	filters = append(filters, gift.Resize(width, height, f.resampling))
+
+	if f.sharpen && (width < sw || height < sh) {
+		filters = append(filters, autoSharpenFilter())
+	}
+	return filters
+}
+
+// scaled multiplies a dimension by scale, rounding to at least one pixel.
+func scaled(size int, scale float64) int {
+	return max(1, int(math.Round(float64(size)*scale)))
+}
+
+// padFilter places an image on a width x height canvas filled with a background color,
+// positioned according to anchor. Used to letterbox images for fit=contain.
+type padFilter struct {
+	width, height int
+	anchor        gift.Anchor
+	background    color.Color
+}
+
+// Bounds returns the canvas size.
+func (f padFilter) Bounds(image.Rectangle) image.Rectangle {
+	return image.Rect(0, 0, f.width, f.height)
+}
+
+// Draw fills dst with the background and composites src over it.
+func (f padFilter) Draw(dst draw.Image, src image.Image, _ *gift.Options) {
+	bounds := dst.Bounds()
+	draw.Draw(dst, bounds, image.NewUniform(f.background), image.Point{}, draw.Src)
+
+	offset := anchorOffset(bounds.Size(), src.Bounds().Size(), f.anchor)
+	target := image.Rectangle{Min: bounds.Min.Add(offset), Max: bounds.Min.Add(offset).Add(src.Bounds().Size())}
+	draw.Draw(dst, target, src, src.Bounds().Min, draw.Over)
+}
+
+// anchorOffset returns where an inner box of the given size is placed within an outer
+// box according to anchor, relative to the outer box's origin.
+func anchorOffset(outer, inner image.Point, anchor gift.Anchor) image.Point {
+	dx, dy := outer.X-inner.X, outer.Y-inner.Y
+
+	x, y := dx/2, dy/2
+	switch anchor {
+	case gift.TopLeftAnchor, gift.LeftAnchor, gift.BottomLeftAnchor:
+		x = 0
+	case gift.TopRightAnchor, gift.RightAnchor, gift.BottomRightAnchor:
+		x = dx
+	}
+	switch anchor {
+	case gift.TopLeftAnchor, gift.TopAnchor, gift.TopRightAnchor:
+		y = 0
+	case gift.BottomLeftAnchor, gift.BottomAnchor, gift.BottomRightAnchor:
+		y = dy
+	}
+	return image.Pt(x, y)
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"go-image-processing-service/internal/logging"
+)
+
+// Settings holds the tunables shared by every handler.
+type Settings struct {
+	// MaxUploadBytes caps the memory used to parse a multipart upload. The server also
+	// rejects request bodies larger than this with 413.
+	MaxUploadBytes int64
+	// MaxWidth and MaxHeight cap the dimensions of uploaded images and of the output of
+	// resizing requests; 0 means no limit.
+	MaxWidth  int
+	MaxHeight int
+	// MaxMegapixels caps the pixel count of uploaded images, and of the output of
+	// resizing requests; 0 means no limit.
+	MaxMegapixels float64
+	// DefaultJPEGQuality is used for JPEG output when a request gives no quality.
+	DefaultJPEGQuality int
+	// MaxConcurrentJobs caps the images processed at once by handlers wrapped in Admit;
+	// 0 means no limit. MaxConcurrentMegapixels additionally caps their total pixel
+	// count; 0 means no pixel budget.
+	MaxConcurrentJobs       int
+	MaxConcurrentMegapixels float64
+	// QueueDepth is how many requests may wait for admission, for up to QueueTimeout.
+	QueueDepth   int
+	QueueTimeout time.Duration
+	// Recorder, when not nil, receives measurements of the image work.
+	Recorder Recorder
+}
+
+// Recorder receives measurements of the image work done by the handlers.
+type Recorder interface {
+	// ObserveStage records the duration of a stage: "decode", "transform" or "encode".
+	ObserveStage(stage string, d time.Duration)
+	// ObserveSourceFormat counts a decoded upload of the given format.
+	ObserveSourceFormat(format string)
+}
+
+// observeStage reports the time elapsed since start for a stage to the Recorder, and
+// adds it to the log fields of the request of ctx.
+func observeStage(ctx context.Context, stage string, start time.Time) {
+	d := time.Since(start)
+	if settings.Recorder != nil {
+		settings.Recorder.ObserveStage(stage, d)
+	}
+	logging.AddFields(ctx, logging.Duration(stage, d))
+}
+
+// DefaultSettings returns the settings used until Configure is called.
+func DefaultSettings() Settings {
+	return Settings{
+		MaxUploadBytes:     32 << 20,
+		MaxMegapixels:      100,
+		DefaultJPEGQuality: 75,
+	}
+}
+
+// settings are the active handler settings.
+var settings = DefaultSettings()
+
+// Configure replaces the handler settings. It must be called before the handlers
+// start serving requests.
+func Configure(s Settings) {
+	settings = s
+	admission = newAdmissionController(s)
+}
@@ -0,0 +1,298 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/disintegration/gift"
+
+	"go-image-processing-service/internal/logging"
+)
+
+// smartCropHeader is the response header reporting the region chosen by a smart crop,
+// as "x,y,width,height" in the pixel coordinates of the (autorotated) source image.
+const smartCropHeader = "X-Crop-Rect"
+
+// Weights of the per-pixel features used to score smart crop windows.
+const (
+	smartCropEdgeWeight       = 1.0
+	smartCropSaturationWeight = 0.3
+	smartCropSkinWeight       = 1.8
+	// smartCropAnalysisSize is the longest side of the downscaled image that is scored.
+	smartCropAnalysisSize = 128
+)
+
+// smartCropFilter crops the most interesting region with the aspect ratio of
+// width x height and scales it to that size.
+//
+// The window is always the largest one with the target aspect ratio that fits in the
+// source, so its size only depends on the source dimensions; its position is chosen
+// from the content when the filter is drawn, unless rect has been fixed with locate.
+type smartCropFilter struct {
+	width, height int
+	resampling    gift.Resampling
+	// withoutEnlargement skips the final resize when the window is smaller than the target.
+	withoutEnlargement bool
+	// sharpen applies a mild unsharp mask when the window is scaled down.
+	sharpen bool
+	// rect is the window in source coordinates; when empty it is detected in Draw.
+	rect image.Rectangle
+}
+
+// smartCropFilterFromParams builds a smart crop filter from the required `width` and
+// `height` parameters and the optional resize `filter`, `withoutEnlargement` and
+// `sharpen` ones.
+func smartCropFilterFromParams(params url.Values) (smartCropFilter, error) {
+	width, errW := strconv.Atoi(params.Get("width"))
+	height, errH := strconv.Atoi(params.Get("height"))
+	if errW != nil || errH != nil || width <= 0 || height <= 0 {
+		return smartCropFilter{}, errors.New("invalid or missing 'width' or 'height' parameter. Must be positive integers")
+	}
+	if width > maxOutputDimension || height > maxOutputDimension {
+		return smartCropFilter{}, fmt.Errorf("invalid 'width' or 'height' parameter. Must be at most %d", maxOutputDimension)
+	}
+
+	resampling, err := parseResampling(params.Get("filter"))
+	if err != nil {
+		return smartCropFilter{}, err
+	}
+
+	withoutEnlargement, err := boolParam(params, "withoutEnlargement", false)
+	if err != nil {
+		return smartCropFilter{}, err
+	}
+
+	sharpen, err := boolParam(params, "sharpen", false)
+	if err != nil {
+		return smartCropFilter{}, err
+	}
+
+	return smartCropFilter{
+		width:              width,
+		height:             height,
+		resampling:         resampling,
+		withoutEnlargement: withoutEnlargement,
+		sharpen:            sharpen,
+	}, nil
+}
+
+// window returns the size of the crop window for a source of the given size.
+func (f smartCropFilter) window(srcSize image.Point) image.Point {
+	if srcSize.X*f.height > srcSize.Y*f.width {
+		return image.Pt(max(1, srcSize.Y*f.width/f.height), srcSize.Y)
+	}
+	return image.Pt(srcSize.X, max(1, srcSize.X*f.height/f.width))
+}
+
+// outputSize returns the size of the result for a source of the given size.
+func (f smartCropFilter) outputSize(srcSize image.Point) image.Point {
+	window := f.window(srcSize)
+	if f.withoutEnlargement && window.X < f.width {
+		return window
+	}
+	return image.Pt(f.width, f.height)
+}
+
+// locate returns a copy of the filter with the window fixed to the best region of img,
+// so that every frame of an animation is cropped the same way.
+func (f smartCropFilter) locate(img image.Image) smartCropFilter {
+	f.rect = smartCropRect(img, f.window(img.Bounds().Size()))
+	return f
+}
+
+// Bounds returns the size of the cropped and resized image.
+func (f smartCropFilter) Bounds(srcBounds image.Rectangle) image.Rectangle {
+	return image.Rectangle{Max: f.outputSize(srcBounds.Size())}
+}
+
+// Draw crops the chosen window of src and scales it into dst.
+func (f smartCropFilter) Draw(dst draw.Image, src image.Image, options *gift.Options) {
+	rect := f.rect
+	if rect.Empty() {
+		rect = smartCropRect(src, f.window(src.Bounds().Size()))
+	}
+	size := f.outputSize(src.Bounds().Size())
+
+	g := gift.New(
+		gift.Crop(rect.Add(src.Bounds().Min)),
+		gift.Resize(size.X, size.Y, f.resampling),
+	)
+	if f.sharpen && size.X < rect.Dx() {
+		g.Add(autoSharpenFilter())
+	}
+	if options != nil {
+		g.Options = *options
+	}
+	g.Draw(dst, src)
+}
+
+// smartCropRect returns the window of the given size with the highest interest score,
+// relative to the origin of img.
+//
+// The image is downscaled for analysis and every pixel is scored by its edge energy
+// (a Laplacian of luminance), its saturation and how close it is to a skin tone. A
+// summed-area table then gives the total score of each candidate window in constant
+// time. A small bias towards the center breaks ties, so featureless images are
+// center-cropped.
+func smartCropRect(img image.Image, window image.Point) image.Rectangle {
+	srcSize := img.Bounds().Size()
+	if window.X >= srcSize.X && window.Y >= srcSize.Y {
+		return image.Rectangle{Max: srcSize}
+	}
+
+	scale := math.Min(1, float64(smartCropAnalysisSize)/float64(max(srcSize.X, srcSize.Y)))
+	aw, ah := scaled(srcSize.X, scale), scaled(srcSize.Y, scale)
+	g := gift.New(gift.Resize(aw, ah, gift.BoxResampling))
+	analysis := image.NewNRGBA(g.Bounds(img.Bounds()))
+	g.Draw(analysis, img)
+
+	scores := smartCropScores(analysis)
+
+	// sums[y][x] holds the total score of the pixels above and to the left of (x, y).
+	sums := make([][]float64, ah+1)
+	for y := range sums {
+		sums[y] = make([]float64, aw+1)
+	}
+	for y := 0; y < ah; y++ {
+		for x := 0; x < aw; x++ {
+			sums[y+1][x+1] = scores[y*aw+x] + sums[y][x+1] + sums[y+1][x] - sums[y][x]
+		}
+	}
+
+	ww, wh := min(aw, max(1, scaled(window.X, scale))), min(ah, max(1, scaled(window.Y, scale)))
+	maxX, maxY := aw-ww, ah-wh
+	bestX, bestY, bestScore := maxX/2, maxY/2, math.Inf(-1)
+	for y := 0; y <= maxY; y++ {
+		for x := 0; x <= maxX; x++ {
+			score := sums[y+wh][x+ww] - sums[y][x+ww] - sums[y+wh][x] + sums[y][x]
+			score *= 1 - 0.01*centerDistance(x, maxX) - 0.01*centerDistance(y, maxY)
+			if score > bestScore {
+				bestX, bestY, bestScore = x, y, score
+			}
+		}
+	}
+
+	// Map the window back to source coordinates, keeping it inside the image.
+	x := min(int(math.Round(float64(bestX)/scale)), srcSize.X-window.X)
+	y := min(int(math.Round(float64(bestY)/scale)), srcSize.Y-window.Y)
+	return image.Rect(x, y, x+window.X, y+window.Y)
+}
+
+// centerDistance returns how far pos is from the middle of [0, limit], from 0 to 1.
+func centerDistance(pos, limit int) float64 {
+	if limit == 0 {
+		return 0
+	}
+	return math.Abs(float64(pos)/float64(limit)-0.5) * 2
+}
+
+// smartCropScores returns the interest score of every pixel of img in row-major order.
+func smartCropScores(img *image.NRGBA) []float64 {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	luma := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := img.NRGBAAt(bounds.Min.X+x, bounds.Min.Y+y)
+			luma[y*w+x] = (0.2126*float64(c.R) + 0.7152*float64(c.G) + 0.0722*float64(c.B)) / 255
+		}
+	}
+	at := func(x, y int) float64 {
+		return luma[min(max(y, 0), h-1)*w+min(max(x, 0), w-1)]
+	}
+
+	scores := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := img.NRGBAAt(bounds.Min.X+x, bounds.Min.Y+y)
+			r, g, b := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+			alpha := float64(c.A) / 255
+
+			edge := math.Abs(4*at(x, y) - at(x-1, y) - at(x+1, y) - at(x, y-1) - at(x, y+1))
+
+			hi, lo := math.Max(r, math.Max(g, b)), math.Min(r, math.Min(g, b))
+			saturation := 0.0
+			if hi > 0 {
+				saturation = (hi - lo) / hi
+			}
+
+			scores[y*w+x] = alpha * (smartCropEdgeWeight*math.Min(edge, 1) +
+				smartCropSaturationWeight*saturation +
+				smartCropSkinWeight*skinScore(r, g, b))
+		}
+	}
+	return scores
+}
+
+// skinScore returns how close a color is to a typical skin tone, from 0 to 1, by
+// comparing its normalized chromaticity to a reference.
+func skinScore(r, g, b float64) float64 {
+	const skinR, skinG, skinB = 0.78, 0.57, 0.44
+
+	length := math.Sqrt(r*r + g*g + b*b)
+	if length < 0.2 || length > 1.6 {
+		return 0
+	}
+	refLength := math.Sqrt(skinR*skinR + skinG*skinG + skinB*skinB)
+	dr, dg, db := r/length-skinR/refLength, g/length-skinG/refLength, b/length-skinB/refLength
+	score := 1 - math.Sqrt(dr*dr+dg*dg+db*db)*4
+	return math.Max(score, 0)
+}
+
+// formatRect formats a rectangle as "x,y,width,height" for smartCropHeader.
+func formatRect(rect image.Rectangle) string {
+	return fmt.Sprintf("%d,%d,%d,%d", rect.Min.X, rect.Min.Y, rect.Dx(), rect.Dy())
+}
+
+// SmartCropHandler crops an image to the most interesting region for a target size.
+//
+// It expects a POST request with a form field named "image" containing the image file,
+// and requires `width` and `height` query parameters. The largest window with that aspect
+// ratio is placed where edges, saturated colors and skin tones are densest, cropped and
+// scaled to width x height. `filter`, `withoutEnlargement` and `sharpen` work as for
+// ResizeHandler.
+//
+// The chosen region is reported in the X-Crop-Rect header as "x,y,width,height" in source
+// pixels. The output format is chosen by outputFormat, and the encoder and `metadata`
+// parameters are the same as for the other endpoints.
+func SmartCropHandler(w http.ResponseWriter, r *http.Request) {
+	src, err := decodeImageFromRequest(r)
+	if err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	filter, err := smartCropFilterFromParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkOutput(src.image.Bounds(), src.frames(), filter); err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	format, err := outputFormat(r, src)
+	if err != nil {
+		http.Error(w, err.Error(), outputFormatStatus(err))
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+
+	filter = filter.locate(src.image)
+	w.Header().Set(smartCropHeader, formatRect(filter.rect))
+	logging.AddFields(r.Context(), "crop_rect", formatRect(filter.rect))
+
+	dst := transformImage(src, format, filter)
+
+	if err := writeImage(w, dst, format, encodeOptionsFromParams(r.URL.Query())); err != nil {
+		http.Error(w, "Could not encode cropped image", http.StatusInternalServerError)
+	}
+}
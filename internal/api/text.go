@@ -0,0 +1,216 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/gift"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// maxTextLength caps the number of characters of a text watermark.
+const maxTextLength = 1000
+
+// textFonts maps the values of the `font` parameter to the bundled Go fonts, so that
+// text rendering does not depend on fonts installed on the host.
+var textFonts = map[string][]byte{
+	"regular": goregular.TTF,
+	"bold":    gobold.TTF,
+	"mono":    gomono.TTF,
+}
+
+// parsedFonts caches the parsed bundled fonts by name.
+var parsedFonts sync.Map
+
+// loadFont returns the parsed bundled font with the given name.
+func loadFont(name string) (*opentype.Font, error) {
+	if f, ok := parsedFonts.Load(name); ok {
+		return f.(*opentype.Font), nil
+	}
+	data, ok := textFonts[name]
+	if !ok {
+		return nil, errors.New("invalid 'font' parameter. Supported: regular, bold, mono")
+	}
+	f, err := opentype.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not load font %q: %v", name, err)
+	}
+	parsedFonts.Store(name, f)
+	return f, nil
+}
+
+// textStyle describes how a text watermark is rendered.
+type textStyle struct {
+	size  float64
+	color color.Color
+	// shadow, when not nil, is drawn below the text, offset down and to the right.
+	shadow color.Color
+	// outline, when not nil, is drawn around the glyphs, outlineWidth pixels thick.
+	outline      color.Color
+	outlineWidth int
+}
+
+// textFilter builds a filter that draws the `text` parameter onto the image. Newlines
+// in the text start new lines.
+//
+// Optional parameters:
+//   - `font`: regular (default), bold or mono, all bundled with the service.
+//   - `size`: font size in pixels, from 4 to 500 (default 24).
+//   - `color`: #RRGGBB or #RRGGBBAA text color (default white).
+//   - `opacity`: from 0 to 1 (default 1), applied to the text and its effects.
+//   - `gravity`: where the text is placed (default southeast).
+//   - `padding`: distance in pixels from the edges the text is anchored to (default 10).
+//   - `shadow`: #RRGGBB or #RRGGBBAA color of a drop shadow.
+//   - `outline`: #RRGGBB or #RRGGBBAA color of an outline, `outlineWidth` (1-10,
+//     default 1) pixels thick.
+func textFilter(params url.Values) (gift.Filter, error) {
+	text := params.Get("text")
+	if strings.TrimSpace(text) == "" {
+		return nil, errors.New("missing 'text' parameter")
+	}
+	if len([]rune(text)) > maxTextLength {
+		return nil, fmt.Errorf("'text' parameter is too long. Maximum: %d characters", maxTextLength)
+	}
+
+	fontName := params.Get("font")
+	if fontName == "" {
+		fontName = "regular"
+	}
+	ttf, err := loadFont(fontName)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := optionalFloatParam(params, "size", 4, 500, 24)
+	if err != nil {
+		return nil, err
+	}
+	style := textStyle{size: float64(size), outlineWidth: 1}
+
+	if style.color, err = colorParam(params.Get("color"), color.White); err != nil {
+		return nil, fmt.Errorf("invalid 'color' parameter: %v", err)
+	}
+	if style.shadow, err = colorParam(params.Get("shadow"), nil); err != nil {
+		return nil, fmt.Errorf("invalid 'shadow' parameter: %v", err)
+	}
+	if style.outline, err = colorParam(params.Get("outline"), nil); err != nil {
+		return nil, fmt.Errorf("invalid 'outline' parameter: %v", err)
+	}
+	if v := params.Get("outlineWidth"); v != "" {
+		style.outlineWidth, err = strconv.Atoi(v)
+		if err != nil || style.outlineWidth < 1 || style.outlineWidth > 10 {
+			return nil, errors.New("invalid 'outlineWidth' parameter. Must be an integer between 1 and 10")
+		}
+	}
+
+	anchor := gift.BottomRightAnchor
+	if params.Get("gravity") != "" {
+		if anchor, err = parseGravity(params.Get("gravity")); err != nil {
+			return nil, err
+		}
+	}
+
+	padding := 10
+	if v := params.Get("padding"); v != "" {
+		padding, err = strconv.Atoi(v)
+		if err != nil || padding < 0 {
+			return nil, errors.New("invalid 'padding' parameter. Must be a non-negative integer")
+		}
+	}
+
+	opacity, err := optionalFloatParam(params, "opacity", 0, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	rendered, err := renderText(ttf, strings.Split(text, "\n"), style)
+	if err != nil {
+		return nil, err
+	}
+
+	// Padding only applies to the edges the text is anchored to.
+	offset := image.Pt(padding, padding)
+	switch anchor {
+	case gift.TopAnchor, gift.CenterAnchor, gift.BottomAnchor:
+		offset.X = 0
+	}
+	switch anchor {
+	case gift.LeftAnchor, gift.CenterAnchor, gift.RightAnchor:
+		offset.Y = 0
+	}
+
+	return overlayFilter{overlay: rendered, anchor: anchor, offset: offset, opacity: float64(opacity)}, nil
+}
+
+// renderText draws lines of text with style onto a transparent image just large
+// enough to hold them and their shadow and outline. Text that needs an image larger
+// than the configured limits is rejected with an *imageLimitError.
+func renderText(ttf *opentype.Font, lines []string, style textStyle) (*image.NRGBA, error) {
+	face, err := opentype.NewFace(ttf, &opentype.FaceOptions{Size: style.size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, fmt.Errorf("could not create font face: %v", err)
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+	ascent := metrics.Ascent.Ceil()
+
+	textWidth := 0
+	for _, line := range lines {
+		textWidth = max(textWidth, font.MeasureString(face, line).Ceil())
+	}
+
+	// Leave room around the glyphs for the outline and below-right for the shadow.
+	margin, shadowOffset := 0, 0
+	if style.outline != nil {
+		margin = style.outlineWidth
+	}
+	if style.shadow != nil {
+		shadowOffset = max(1, int(style.size/16))
+	}
+
+	// Large sizes and long lines can call for a canvas far bigger than any image, so it
+	// is held to the same limits as uploads before it is allocated.
+	width := textWidth + 2*margin + shadowOffset
+	height := lineHeight*len(lines) + 2*margin + shadowOffset
+	if err := checkDimensions("text", width, height, 1); err != nil {
+		return nil, err
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	drawLines := func(c color.Color, dx, dy int) {
+		drawer := &font.Drawer{Dst: img, Src: image.NewUniform(c), Face: face}
+		for i, line := range lines {
+			drawer.Dot = fixed.P(margin+dx, margin+dy+ascent+i*lineHeight)
+			drawer.DrawString(line)
+		}
+	}
+
+	if style.shadow != nil {
+		drawLines(style.shadow, shadowOffset, shadowOffset)
+	}
+	if style.outline != nil {
+		for dy := -style.outlineWidth; dy <= style.outlineWidth; dy++ {
+			for dx := -style.outlineWidth; dx <= style.outlineWidth; dx++ {
+				if (dx != 0 || dy != 0) && dx*dx+dy*dy <= style.outlineWidth*style.outlineWidth+1 {
+					drawLines(style.outline, dx, dy)
+				}
+			}
+		}
+	}
+	drawLines(style.color, 0, 0)
+
+	return img, nil
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/disintegration/gift"
+
+	"go-image-processing-service/internal/logging"
+)
+
+// overlayFilter composites an overlay image onto the source, either once at a
+// gravity-based position or tiled across the whole image. The output has the
+// source dimensions.
+type overlayFilter struct {
+	overlay image.Image
+	anchor  gift.Anchor
+	// offset moves the overlay away from the edges it is anchored to, or right and down
+	// for centered axes. In tiled mode it is the position of the first tile.
+	offset image.Point
+	// opacity scales the overlay's own alpha, from 0 to 1.
+	opacity float64
+	// scale is the overlay width as a fraction of the source width; 0 keeps its size.
+	scale float64
+	tile  bool
+	// spacing is the gap in pixels between tiles.
+	spacing int
+}
+
+// watermarkFilter builds an overlay filter for overlay from the query parameters.
+//
+// Optional parameters:
+//   - `gravity`: where the overlay is placed (default southeast).
+//   - `offsetX`, `offsetY`: distance in pixels from the anchored edges (default 0).
+//   - `opacity`: from 0 to 1 (default 1).
+//   - `scale`: the overlay width relative to the image width, from 0.01 to 1; the
+//     overlay keeps its own size when omitted.
+//   - `tile`: when true, the overlay is repeated across the image starting at the
+//     offsets, with `spacing` pixels between copies.
+func watermarkFilter(params url.Values, overlay image.Image) (gift.Filter, error) {
+	f := overlayFilter{overlay: overlay, anchor: gift.BottomRightAnchor, opacity: 1}
+
+	var err error
+	if params.Get("gravity") != "" {
+		if f.anchor, err = parseGravity(params.Get("gravity")); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, p := range []struct {
+		name  string
+		value *int
+	}{{"offsetX", &f.offset.X}, {"offsetY", &f.offset.Y}, {"spacing", &f.spacing}} {
+		if v := params.Get(p.name); v != "" {
+			if *p.value, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("invalid '%s' parameter. Must be an integer", p.name)
+			}
+		}
+	}
+	if f.spacing < 0 {
+		return nil, errors.New("invalid 'spacing' parameter. Must not be negative")
+	}
+
+	opacity, err := optionalFloatParam(params, "opacity", 0, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	f.opacity = float64(opacity)
+
+	if params.Get("scale") != "" {
+		scale, err := floatParam(params, "scale", 0.01, 1)
+		if err != nil {
+			return nil, err
+		}
+		f.scale = float64(scale)
+	}
+
+	if f.tile, err = boolParam(params, "tile", false); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Bounds returns the source size.
+func (f overlayFilter) Bounds(srcBounds image.Rectangle) image.Rectangle {
+	return image.Rect(0, 0, srcBounds.Dx(), srcBounds.Dy())
+}
+
+// Draw copies src into dst and composites the overlay over it.
+func (f overlayFilter) Draw(dst draw.Image, src image.Image, options *gift.Options) {
+	bounds := dst.Bounds()
+	draw.Draw(dst, bounds, src, src.Bounds().Min, draw.Src)
+
+	overlay := f.overlay
+	if f.scale > 0 {
+		width := scaled(bounds.Dx(), f.scale)
+		height := scaled(overlay.Bounds().Dy(), float64(width)/float64(overlay.Bounds().Dx()))
+		g := gift.New(gift.Resize(width, height, gift.LanczosResampling))
+		if options != nil {
+			g.Options = *options
+		}
+		resized := image.NewNRGBA(g.Bounds(overlay.Bounds()))
+		g.Draw(resized, overlay)
+		overlay = resized
+	}
+
+	size := overlay.Bounds().Size()
+	if size.X <= 0 || size.Y <= 0 {
+		return
+	}
+	mask := image.NewUniform(color.Alpha{A: uint8(math.Round(f.opacity * 255))})
+
+	if f.tile {
+		stepX, stepY := size.X+f.spacing, size.Y+f.spacing
+		// Start from the tile covering the top-left corner, so offsets only shift the grid.
+		startX, startY := f.offset.X%stepX, f.offset.Y%stepY
+		if startX > 0 {
+			startX -= stepX
+		}
+		if startY > 0 {
+			startY -= stepY
+		}
+		for y := startY; y < bounds.Dy(); y += stepY {
+			for x := startX; x < bounds.Dx(); x += stepX {
+				f.composite(dst, overlay, mask, bounds.Min.Add(image.Pt(x, y)))
+			}
+		}
+		return
+	}
+
+	position := anchorOffset(bounds.Size(), size, f.anchor)
+	switch f.anchor {
+	case gift.TopRightAnchor, gift.RightAnchor, gift.BottomRightAnchor:
+		position.X -= f.offset.X
+	default:
+		position.X += f.offset.X
+	}
+	switch f.anchor {
+	case gift.BottomLeftAnchor, gift.BottomAnchor, gift.BottomRightAnchor:
+		position.Y -= f.offset.Y
+	default:
+		position.Y += f.offset.Y
+	}
+	f.composite(dst, overlay, mask, bounds.Min.Add(position))
+}
+
+// composite draws overlay over dst with its top-left corner at pt, through mask.
+func (f overlayFilter) composite(dst draw.Image, overlay image.Image, mask image.Image, pt image.Point) {
+	target := image.Rectangle{Min: pt, Max: pt.Add(overlay.Bounds().Size())}
+	draw.DrawMask(dst, target, overlay, overlay.Bounds().Min, mask, image.Point{}, draw.Over)
+}
+
+// WatermarkHandler composites an overlay image, such as a logo, onto an uploaded image.
+//
+// It expects a POST request with two form fields: "image", the base image, and "overlay",
+// the image to stamp onto it (typically a PNG with alpha). Position, opacity, size and
+// tiling are controlled by the query parameters described in watermarkFilter.
+// Instead of an overlay file, a `text` query parameter draws text with a bundled font,
+// styled by the parameters described in textFilter.
+//
+// The result keeps the dimensions and, unless overridden (see ResizeHandler), the format
+// of the base image. Animated GIFs are watermarked frame by frame.
+func WatermarkHandler(w http.ResponseWriter, r *http.Request) {
+	src, err := decodeImageFromRequest(r)
+	if err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	filter, err := watermarkFromRequest(r)
+	if err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	format, err := outputFormat(r, src)
+	if err != nil {
+		http.Error(w, err.Error(), outputFormatStatus(err))
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+
+	dst := transformImage(src, format, filter)
+
+	if err := writeImage(w, dst, format, encodeOptionsFromParams(r.URL.Query())); err != nil {
+		http.Error(w, "Could not encode watermarked image", http.StatusInternalServerError)
+	}
+}
+
+// watermarkFromRequest builds the watermark filter from the "overlay" form file or,
+// when there is none, from the `text` query parameter.
+func watermarkFromRequest(r *http.Request) (gift.Filter, error) {
+	file, _, err := r.FormFile("overlay")
+	if err != nil {
+		if r.URL.Query().Get("text") != "" {
+			logging.FromContext(r.Context()).Debug("Watermarking with text", "text", r.URL.Query().Get("text"))
+			return textFilter(r.URL.Query())
+		}
+		return nil, errors.New("could not get overlay file. Provide an 'overlay' file or a 'text' parameter")
+	}
+	defer file.Close()
+
+	overlay, err := decodeImage(file, decodeOptions{autorotate: true})
+	if err != nil {
+		return nil, fmt.Errorf("could not decode overlay: %w", err)
+	}
+
+	logging.AddFields(r.Context(), "overlay_width", overlay.image.Bounds().Dx(), "overlay_height", overlay.image.Bounds().Dy())
+	return watermarkFilter(r.URL.Query(), overlay.image)
+}
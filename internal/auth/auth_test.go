@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testEndpoints = []string{"resize", "crop", "info"}
+
+// writeKeysFile writes contents to a keys file in a temporary directory.
+func writeKeysFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	testCases := []struct {
+		name        string
+		contents    string
+		expectError bool
+	}{
+		{"Valid", "keys:\n  - {name: cms, key: secret, endpoints: [resize], daily_requests: 10}\n", false},
+		{"JSON", `{"keys": [{"name": "cms", "key": "secret"}]}`, false},
+		{"Empty", "", false},
+		{"Missing Key", "keys:\n  - {name: cms}\n", true},
+		{"Duplicate Name", "keys:\n  - {name: cms, key: a}\n  - {name: cms, key: b}\n", true},
+		{"Duplicate Key", "keys:\n  - {name: a, key: secret}\n  - {name: b, key: secret}\n", true},
+		{"Unknown Endpoint", "keys:\n  - {name: cms, key: secret, endpoints: [explode]}\n", true},
+		{"Negative Quota", "keys:\n  - {name: cms, key: secret, daily_bytes: -1}\n", true},
+		{"Unknown Field", "keys:\n  - {name: cms, key: secret, role: admin}\n", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := LoadFile(writeKeysFile(t, tc.contents), testEndpoints)
+			if (err != nil) != tc.expectError {
+				t.Errorf("Expected error %v, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	store, err := LoadFile(writeKeysFile(t, `keys:
+  - {name: full, key: full-secret}
+  - {name: crop-only, key: crop-secret, endpoints: [crop]}
+  - {name: two-requests, key: few-secret, daily_requests: 2}
+  - {name: small, key: small-secret, daily_bytes: 10}
+`), testEndpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2026, 10, 16, 23, 0, 0, 0, time.UTC)
+	authenticator := NewAuthenticator(store, "/api/health")
+	authenticator.quotas.now = func() time.Time { return now }
+
+	var seenQuery, seenKey string
+	handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenQuery = r.URL.RawQuery
+		if key, ok := KeyFromContext(r.Context()); ok {
+			seenKey = key.Name
+		}
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte("OK"))
+	}))
+
+	testCases := []struct {
+		name           string
+		path           string
+		authorization  string
+		body           string
+		advance        time.Duration
+		expectedStatus int
+		expectedKey    string
+	}{
+		{"Public Path", "/api/health", "", "", 0, http.StatusOK, ""},
+		{"Missing Key", "/api/resize", "", "", 0, http.StatusUnauthorized, ""},
+		{"Invalid Key", "/api/resize", "Bearer wrong", "", 0, http.StatusUnauthorized, ""},
+		{"Wrong Scheme", "/api/resize", "Basic full-secret", "", 0, http.StatusUnauthorized, ""},
+		{"Header Key", "/api/resize", "Bearer full-secret", "", 0, http.StatusOK, "full"},
+		{"Query Key", "/api/resize?width=10&api_key=full-secret", "", "", 0, http.StatusOK, "full"},
+		{"Allowed Endpoint", "/api/crop", "Bearer crop-secret", "", 0, http.StatusOK, "crop-only"},
+		{"Forbidden Endpoint", "/api/resize", "Bearer crop-secret", "", 0, http.StatusForbidden, ""},
+		{"First Request Of Quota", "/api/info", "Bearer few-secret", "", 0, http.StatusOK, "two-requests"},
+		{"Second Request Of Quota", "/api/info", "Bearer few-secret", "", 0, http.StatusOK, "two-requests"},
+		{"Request Quota Exceeded", "/api/info", "Bearer few-secret", "", 0, http.StatusTooManyRequests, ""},
+		{"Request Quota Reset Next Day", "/api/info", "Bearer few-secret", "", 2 * time.Hour, http.StatusOK, "two-requests"},
+		{"Declared Body Over Byte Quota", "/api/info", "Bearer small-secret", "more than ten bytes", 0, http.StatusTooManyRequests, ""},
+		{"Within Byte Quota", "/api/info", "Bearer small-secret", "12345678", 0, http.StatusOK, "small"},
+		{"Byte Quota Exceeded", "/api/info", "Bearer small-secret", "", 0, http.StatusTooManyRequests, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			now = now.Add(tc.advance)
+			seenQuery, seenKey = "", ""
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			if recorder.Code != tc.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d: %s", tc.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+			if seenKey != tc.expectedKey {
+				t.Errorf("Expected handler to see key %q, got %q", tc.expectedKey, seenKey)
+			}
+			if strings.Contains(seenQuery, QueryParam) {
+				t.Errorf("Expected the API key to be removed from the query, got %q", seenQuery)
+			}
+			switch tc.expectedStatus {
+			case http.StatusUnauthorized:
+				if recorder.Header().Get("WWW-Authenticate") == "" {
+					t.Error("Expected a WWW-Authenticate header")
+				}
+			case http.StatusTooManyRequests:
+				if recorder.Header().Get("Retry-After") == "" {
+					t.Error("Expected a Retry-After header")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-image-processing-service/internal/httpx"
+	"go-image-processing-service/internal/logging"
+)
+
+// QueryParam is the query parameter that can carry the API key instead of the
+// Authorization header.
+const QueryParam = "api_key"
+
+// contextKey is the type of the request context key holding the authenticated Key.
+type contextKey struct{}
+
+// KeyFromContext returns the API key a request was authenticated with.
+func KeyFromContext(ctx context.Context) (Key, bool) {
+	key, ok := ctx.Value(contextKey{}).(Key)
+	return key, ok
+}
+
+// Authenticator checks the API key of every request against a Store and enforces the
+// endpoints and daily quotas of the key.
+type Authenticator struct {
+	store  Store
+	quotas *quotas
+	// public lists the paths served without a key, such as the health check.
+	public []string
+}
+
+// NewAuthenticator returns an Authenticator using the keys of store. Requests for the
+// public paths are served without a key.
+func NewAuthenticator(store Store, public ...string) *Authenticator {
+	return &Authenticator{store: store, quotas: newQuotas(time.Now), public: public}
+}
+
+// Middleware authenticates requests before passing them to next. The key is read from
+// an `Authorization: Bearer <key>` header or the api_key query parameter, and the
+// endpoint is the first path segment after /api/.
+//
+// It responds with 401 when the key is missing or unknown, 403 when the key may not call
+// the endpoint and 429, with Retry-After, when the key has used up a daily quota.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range a.public {
+			if r.URL.Path == path {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		secret := RequestKey(r)
+		if secret == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="image-service"`)
+			http.Error(w, "missing API key. Provide an 'Authorization: Bearer <key>' header or an 'api_key' parameter", http.StatusUnauthorized)
+			return
+		}
+		key, ok := a.store.Lookup(secret)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="image-service", error="invalid_token"`)
+			http.Error(w, "invalid API key", http.StatusUnauthorized)
+			return
+		}
+
+		endpoint, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/"), "/")
+		if !key.AllowsEndpoint(endpoint) {
+			http.Error(w, "API key is not allowed to call this endpoint", http.StatusForbidden)
+			return
+		}
+
+		if !a.quotas.admit(key, max(r.ContentLength, 0)) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(a.quotas.untilReset().Seconds())+1))
+			http.Error(w, "daily quota exceeded for this API key", http.StatusTooManyRequests)
+			return
+		}
+
+		stripQueryKey(r)
+
+		body := &httpx.CountingReader{ReadCloser: r.Body}
+		r.Body = body
+		rw := httpx.NewResponseRecorder(w)
+		defer func() {
+			a.quotas.addBytes(key, body.N+rw.Bytes)
+		}()
+
+		logging.AddFields(r.Context(), "api_key", key.Name)
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), contextKey{}, key)))
+	})
+}
+
+// Identify returns the key a request presents, if it is valid, without checking its
+// endpoints or quotas.
+func (a *Authenticator) Identify(r *http.Request) (Key, bool) {
+	secret := RequestKey(r)
+	if secret == "" {
+		return Key{}, false
+	}
+	return a.store.Lookup(secret)
+}
+
+// RequestKey returns the API key of the request, from the Authorization header or the
+// query string.
+func RequestKey(r *http.Request) string {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return r.URL.Query().Get(QueryParam)
+}
+
+// stripQueryKey removes the API key from the query string so that handlers and logs
+// never see it.
+func stripQueryKey(r *http.Request) {
+	query := r.URL.Query()
+	if !query.Has(QueryParam) {
+		return
+	}
+	query.Del(QueryParam)
+	r.URL.RawQuery = query.Encode()
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// usage is what a key consumed on one UTC day.
+type usage struct {
+	day      string
+	requests int64
+	bytes    int64
+}
+
+// quotas tracks the daily usage of every key in memory. Usage is lost on restart.
+type quotas struct {
+	mu    sync.Mutex
+	usage map[string]*usage // by key name
+	now   func() time.Time
+}
+
+func newQuotas(now func() time.Time) *quotas {
+	return &quotas{usage: make(map[string]*usage), now: now}
+}
+
+// current returns the usage of key for today, resetting it on a new day. q.mu must be held.
+func (q *quotas) current(key Key) *usage {
+	day := q.now().UTC().Format(time.DateOnly)
+	u, ok := q.usage[key.Name]
+	if !ok || u.day != day {
+		u = &usage{day: day}
+		q.usage[key.Name] = u
+	}
+	return u
+}
+
+// admit counts a request against key's quotas. It returns false, counting nothing, when
+// the key has used up its daily requests, or when its remaining daily bytes cannot
+// cover the declared request body size.
+func (q *quotas) admit(key Key, size int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.current(key)
+	if key.DailyRequests > 0 && u.requests >= key.DailyRequests {
+		return false
+	}
+	if key.DailyBytes > 0 && u.bytes+max(size, 1) > key.DailyBytes {
+		return false
+	}
+	u.requests++
+	return true
+}
+
+// addBytes counts n transferred bytes against key's daily byte quota.
+func (q *quotas) addBytes(key Key, n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.current(key).bytes += n
+}
+
+// untilReset returns the time left until the quotas reset at midnight UTC.
+func (q *quotas) untilReset() time.Duration {
+	now := q.now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return midnight.Sub(now)
+}
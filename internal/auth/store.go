@@ -0,0 +1,105 @@
+// Package auth authenticates API requests with API keys and enforces the endpoints and
+// daily quotas granted to each key.
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Key describes an API key and what it is allowed to do.
+type Key struct {
+	// Name identifies the key in logs and quota accounting; it is not a secret.
+	Name string `yaml:"name"`
+	// Key is the secret clients present.
+	Key string `yaml:"key"`
+	// Endpoints lists the endpoints the key may call, by their name under /api/. An
+	// empty list allows every endpoint.
+	Endpoints []string `yaml:"endpoints"`
+	// DailyRequests and DailyBytes cap the requests and the bytes transferred (request
+	// plus response bodies) per UTC day; 0 means no limit.
+	DailyRequests int64 `yaml:"daily_requests"`
+	DailyBytes    int64 `yaml:"daily_bytes"`
+}
+
+// AllowsEndpoint reports whether the key may call the named endpoint.
+func (k Key) AllowsEndpoint(name string) bool {
+	return len(k.Endpoints) == 0 || slices.Contains(k.Endpoints, name)
+}
+
+// Store looks up API keys.
+type Store interface {
+	// Lookup returns the key matching secret, if any.
+	Lookup(secret string) (Key, bool)
+}
+
+// FileStore is a Store holding the keys of a YAML or JSON file such as:
+//
+//	keys:
+//	  - name: cms
+//	    key: 3f1c...
+//	    endpoints: [resize, crop]
+//	    daily_requests: 10000
+//	    daily_bytes: 1073741824
+type FileStore struct {
+	// keys is indexed by the SHA-256 digest of the secret, so that lookups do not
+	// compare secrets byte by byte.
+	keys map[[sha256.Size]byte]Key
+}
+
+// LoadFile reads a FileStore from path. Every endpoint a key lists must be in endpoints.
+func LoadFile(path string, endpoints []string) (*FileStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read API keys file: %v", err)
+	}
+
+	var file struct {
+		Keys []Key `yaml:"keys"`
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("could not parse API keys file %s: %v", path, err)
+	}
+
+	store := &FileStore{keys: make(map[[sha256.Size]byte]Key, len(file.Keys))}
+	names := make(map[string]bool, len(file.Keys))
+	for i, key := range file.Keys {
+		if key.Name == "" || strings.TrimSpace(key.Key) == "" {
+			return nil, fmt.Errorf("API key %d: name and key are required", i+1)
+		}
+		if names[key.Name] {
+			return nil, fmt.Errorf("API key %q: duplicate name", key.Name)
+		}
+		names[key.Name] = true
+		digest := sha256.Sum256([]byte(key.Key))
+		if _, ok := store.keys[digest]; ok {
+			return nil, fmt.Errorf("API key %q: duplicate key", key.Name)
+		}
+		if key.DailyRequests < 0 || key.DailyBytes < 0 {
+			return nil, fmt.Errorf("API key %q: quotas must not be negative", key.Name)
+		}
+		for _, endpoint := range key.Endpoints {
+			if !slices.Contains(endpoints, endpoint) {
+				return nil, fmt.Errorf("API key %q: unknown endpoint %q", key.Name, endpoint)
+			}
+		}
+		store.keys[digest] = key
+	}
+	return store, nil
+}
+
+// Lookup returns the key matching secret, if any.
+func (s *FileStore) Lookup(secret string) (Key, bool) {
+	key, ok := s.keys[sha256.Sum256([]byte(secret))]
+	return key, ok
+}
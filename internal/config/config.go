@@ -0,0 +1,426 @@
+// Package config loads the service configuration from defaults, an optional YAML or
+// JSON file, environment variables and command-line flags, in increasing order of
+// precedence.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"go-image-processing-service/internal/logging"
+	"go-image-processing-service/internal/ratelimit"
+)
+
+// envPrefix prefixes the environment variable of every option, e.g. IMAGE_SERVICE_LISTEN_ADDR.
+const envPrefix = "IMAGE_SERVICE_"
+
+// Endpoints lists the names of the endpoints that can be enabled, which are also their
+// paths under /api/. The health check is always enabled.
+var Endpoints = []string{
+	"resize", "compress", "convert", "flip", "rotate", "crop", "smartcrop", "adjust",
+	"blur", "sharpen", "watermark", "process", "info",
+}
+
+// Config holds the settings of the service.
+type Config struct {
+	// ListenAddr is the host:port the HTTP server listens on.
+	ListenAddr string `yaml:"listen_addr"`
+	// MaxUploadBytes caps the size of a whole request body, multipart encoding
+	// included; larger requests are rejected with 413.
+	MaxUploadBytes int64 `yaml:"max_upload_bytes"`
+	// MaxWidth and MaxHeight cap the dimensions of uploaded images and of resized
+	// output; 0 means no limit.
+	MaxWidth  int `yaml:"max_width"`
+	MaxHeight int `yaml:"max_height"`
+	// MaxMegapixels caps the pixel count of uploaded images and of resized output, in
+	// millions of pixels, counting every frame of an animation; 0 means no limit.
+	MaxMegapixels float64 `yaml:"max_megapixels"`
+	// CORSOrigins lists the origins allowed to call the API from a browser, such as
+	// "https://app.example.com". "https://*.example.com" allows any subdomain and "*"
+	// allows any origin.
+	CORSOrigins []string `yaml:"cors_origins"`
+	// CORSAllowCredentials lets browsers send cookies and HTTP authentication to the API.
+	// It cannot be combined with the "*" origin.
+	CORSAllowCredentials bool `yaml:"cors_allow_credentials"`
+	// CORSMethods and CORSHeaders list the methods and request headers allowed in
+	// cross-origin requests, and CORSExposeHeaders the response headers scripts may read.
+	CORSMethods       []string `yaml:"cors_methods"`
+	CORSHeaders       []string `yaml:"cors_headers"`
+	CORSExposeHeaders []string `yaml:"cors_expose_headers"`
+	// CORSMaxAge is how long browsers may cache a preflight response; 0 leaves it to
+	// the browser.
+	CORSMaxAge time.Duration `yaml:"cors_max_age"`
+	// ReadTimeout, WriteTimeout, IdleTimeout and ReadHeaderTimeout configure the
+	// matching http.Server timeouts.
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	// ShutdownTimeout bounds how long in-flight requests may take to finish once the
+	// server is asked to stop.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// DefaultJPEGQuality is used when a request producing JPEG gives no quality.
+	DefaultJPEGQuality int `yaml:"default_jpeg_quality"`
+	// EnabledEndpoints lists the endpoints that are served, out of Endpoints.
+	EnabledEndpoints []string `yaml:"enabled_endpoints"`
+	// APIKeysFile names a YAML or JSON file of API keys. When set, every endpoint but the
+	// health check requires one of its keys; when empty, the API is open.
+	APIKeysFile string `yaml:"api_keys_file"`
+	// RateLimit is the sustained number of requests per second allowed per client, and
+	// RateBurst the number that can be made at once. Clients are identified by API key,
+	// or by address without one. A RateLimit of 0, the default, disables rate limiting.
+	RateLimit float64 `yaml:"rate_limit"`
+	RateBurst int     `yaml:"rate_burst"`
+	// MaxConcurrentJobs caps the images processed at once (0 for no limit), and
+	// MaxConcurrentMegapixels the total pixel count of the images being processed (0
+	// for no budget). QueueDepth requests may wait up to QueueTimeout for their turn;
+	// others are rejected with 503.
+	MaxConcurrentJobs       int           `yaml:"max_concurrent_jobs"`
+	MaxConcurrentMegapixels float64       `yaml:"max_concurrent_megapixels"`
+	QueueDepth              int           `yaml:"queue_depth"`
+	QueueTimeout            time.Duration `yaml:"queue_timeout"`
+	// MetricsEnabled serves Prometheus metrics at /metrics, outside /api/ and without
+	// authentication, on the API listener. It is off by default, since anyone who can
+	// reach the listener can then read the metrics.
+	MetricsEnabled bool `yaml:"metrics_enabled"`
+	// LogLevel is the minimum level logged: debug, info, warn or error. LogFormat is
+	// json or text.
+	LogLevel  string `yaml:"log_level"`
+	LogFormat string `yaml:"log_format"`
+	// TrustedProxies lists the addresses or CIDR ranges of the proxies whose
+	// X-Forwarded-For header is trusted to give the client address.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+// Default returns the configuration used when nothing is overridden.
+func Default() Config {
+	return Config{
+		ListenAddr:              "0.0.0.0:8080",
+		MaxUploadBytes:          32 << 20,
+		MaxMegapixels:           100,
+		CORSOrigins:             []string{"*"},
+		CORSMethods:             []string{"POST", "GET", "OPTIONS", "PUT", "DELETE"},
+		CORSHeaders:             []string{"Accept", "Content-Type", "Content-Length", "Accept-Encoding", "X-CSRF-Token", "Authorization", "X-Request-ID"},
+		CORSExposeHeaders:       []string{"X-Crop-Rect", "X-Request-ID", "Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"},
+		CORSMaxAge:              10 * time.Minute,
+		ReadTimeout:             30 * time.Second,
+		WriteTimeout:            60 * time.Second,
+		IdleTimeout:             120 * time.Second,
+		ReadHeaderTimeout:       10 * time.Second,
+		ShutdownTimeout:         30 * time.Second,
+		DefaultJPEGQuality:      75,
+		EnabledEndpoints:        slices.Clone(Endpoints),
+		MaxConcurrentJobs:       runtime.NumCPU(),
+		MaxConcurrentMegapixels: 200,
+		QueueDepth:              100,
+		QueueTimeout:            10 * time.Second,
+		MetricsEnabled:          false,
+		LogLevel:                "info",
+		LogFormat:               "json",
+		RateLimit:               0,
+		RateBurst:               20,
+		TrustedProxies:          []string{"127.0.0.1", "::1"},
+	}
+}
+
+// option describes a setting that can be given as an environment variable or a flag.
+type option struct {
+	name  string // flag name; the environment variable is derived from it
+	usage string
+	set   func(c *Config, value string) error
+}
+
+// env returns the environment variable name of the option.
+func (o option) env() string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(o.name, "-", "_"))
+}
+
+// options lists the settings that can be overridden from the environment and flags.
+var options = []option{
+	{"listen-addr", "host:port to listen on", func(c *Config, v string) error {
+		c.ListenAddr = v
+		return nil
+	}},
+	{"max-upload-bytes", "maximum request body size in bytes", func(c *Config, v string) (err error) {
+		c.MaxUploadBytes, err = strconv.ParseInt(v, 10, 64)
+		return err
+	}},
+	{"max-width", "maximum image width in pixels (0 for no limit)", intSetter(func(c *Config) *int { return &c.MaxWidth })},
+	{"max-height", "maximum image height in pixels (0 for no limit)", intSetter(func(c *Config) *int { return &c.MaxHeight })},
+	{"max-megapixels", "maximum image size in millions of pixels (0 for no limit)", func(c *Config, v string) (err error) {
+		c.MaxMegapixels, err = strconv.ParseFloat(v, 64)
+		return err
+	}},
+	{"cors-origins", "comma-separated list of allowed CORS origins (https://*.example.com for subdomains), or *", func(c *Config, v string) error {
+		c.CORSOrigins = splitList(v)
+		return nil
+	}},
+	{"cors-allow-credentials", "allow credentials in cross-origin requests (true or false)", func(c *Config, v string) (err error) {
+		c.CORSAllowCredentials, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"cors-methods", "comma-separated list of methods allowed in cross-origin requests", func(c *Config, v string) error {
+		c.CORSMethods = splitList(v)
+		return nil
+	}},
+	{"cors-headers", "comma-separated list of request headers allowed in cross-origin requests", func(c *Config, v string) error {
+		c.CORSHeaders = splitList(v)
+		return nil
+	}},
+	{"cors-expose-headers", "comma-separated list of response headers exposed to cross-origin scripts", func(c *Config, v string) error {
+		c.CORSExposeHeaders = splitList(v)
+		return nil
+	}},
+	{"cors-max-age", "how long browsers may cache preflight responses", durationSetter(func(c *Config) *time.Duration { return &c.CORSMaxAge })},
+	{"read-timeout", "maximum duration for reading a request", durationSetter(func(c *Config) *time.Duration { return &c.ReadTimeout })},
+	{"write-timeout", "maximum duration for writing a response", durationSetter(func(c *Config) *time.Duration { return &c.WriteTimeout })},
+	{"idle-timeout", "maximum time to keep an idle connection open", durationSetter(func(c *Config) *time.Duration { return &c.IdleTimeout })},
+	{"read-header-timeout", "maximum duration for reading request headers", durationSetter(func(c *Config) *time.Duration { return &c.ReadHeaderTimeout })},
+	{"shutdown-timeout", "maximum time to wait for in-flight requests when stopping", durationSetter(func(c *Config) *time.Duration { return &c.ShutdownTimeout })},
+	{"default-jpeg-quality", "JPEG quality used when a request gives none (1-100)", intSetter(func(c *Config) *int { return &c.DefaultJPEGQuality })},
+	{"enabled-endpoints", "comma-separated list of endpoints to serve", func(c *Config, v string) error {
+		c.EnabledEndpoints = splitList(v)
+		return nil
+	}},
+	{"rate-limit", "requests per second allowed per client (0 to disable)", func(c *Config, v string) (err error) {
+		c.RateLimit, err = strconv.ParseFloat(v, 64)
+		return err
+	}},
+	{"rate-burst", "requests a client can make at once", intSetter(func(c *Config) *int { return &c.RateBurst })},
+	{"trusted-proxies", "comma-separated addresses or CIDR ranges of proxies trusted for X-Forwarded-For", func(c *Config, v string) error {
+		c.TrustedProxies = splitList(v)
+		return nil
+	}},
+	{"max-concurrent-jobs", "images processed at once (0 for no limit)", intSetter(func(c *Config) *int { return &c.MaxConcurrentJobs })},
+	{"max-concurrent-megapixels", "total millions of pixels processed at once (0 for no limit)", func(c *Config, v string) (err error) {
+		c.MaxConcurrentMegapixels, err = strconv.ParseFloat(v, 64)
+		return err
+	}},
+	{"queue-depth", "requests that may wait for processing when busy", intSetter(func(c *Config) *int { return &c.QueueDepth })},
+	{"queue-timeout", "maximum time a request waits for processing", durationSetter(func(c *Config) *time.Duration { return &c.QueueTimeout })},
+	{"metrics-enabled", "serve Prometheus metrics at /metrics (true or false)", func(c *Config, v string) (err error) {
+		c.MetricsEnabled, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"log-level", "minimum log level: debug, info, warn or error", func(c *Config, v string) error {
+		c.LogLevel = v
+		return nil
+	}},
+	{"log-format", "log format: json or text", func(c *Config, v string) error {
+		c.LogFormat = v
+		return nil
+	}},
+	{"api-keys-file", "path to a YAML or JSON file of API keys; empty leaves the API open", func(c *Config, v string) error {
+		c.APIKeysFile = v
+		return nil
+	}},
+}
+
+// intSetter returns an option setter parsing an integer into the field returned by field.
+func intSetter(field func(c *Config) *int) func(c *Config, v string) error {
+	return func(c *Config, v string) (err error) {
+		*field(c), err = strconv.Atoi(v)
+		return err
+	}
+}
+
+// durationSetter returns an option setter parsing a duration such as "30s".
+func durationSetter(field func(c *Config) *time.Duration) func(c *Config, v string) error {
+	return func(c *Config, v string) (err error) {
+		*field(c), err = time.ParseDuration(v)
+		return err
+	}
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Load builds the configuration from the command-line arguments (without the program
+// name) and the process environment, then validates it.
+//
+// Settings are applied in this order, each overriding the previous ones: defaults, the
+// file named by -config or IMAGE_SERVICE_CONFIG, environment variables, and flags.
+func Load(args []string) (Config, error) {
+	return load(args, os.LookupEnv, os.Stderr)
+}
+
+// load implements Load with an injectable environment and usage output.
+func load(args []string, lookupEnv func(string) (string, bool), output io.Writer) (Config, error) {
+	fs := flag.NewFlagSet("image-service", flag.ContinueOnError)
+	fs.SetOutput(output)
+	configPath := fs.String("config", "", "path to a YAML or JSON configuration file (env "+envPrefix+"CONFIG)")
+	values := make(map[string]*string, len(options))
+	for _, o := range options {
+		values[o.name] = fs.String(o.name, "", o.usage+" (env "+o.env()+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if fs.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	cfg := Default()
+
+	path := *configPath
+	if path == "" {
+		path, _ = lookupEnv(envPrefix + "CONFIG")
+	}
+	if path != "" {
+		if err := loadFile(&cfg, path); err != nil {
+			return Config{}, err
+		}
+	}
+
+	for _, o := range options {
+		if v, ok := lookupEnv(o.env()); ok {
+			if err := o.set(&cfg, v); err != nil {
+				return Config{}, fmt.Errorf("invalid %s: %v", o.env(), err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, o := range options {
+			if o.name == f.Name && flagErr == nil {
+				if err := o.set(&cfg, *values[o.name]); err != nil {
+					flagErr = fmt.Errorf("invalid -%s: %v", o.name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return Config{}, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// loadFile overlays the settings of a YAML or JSON file onto cfg. Since JSON is valid
+// YAML, both are read with the YAML decoder. Unknown keys are rejected.
+func loadFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %v", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("could not parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate reports the first invalid setting.
+func (c Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		return fmt.Errorf("invalid listen address %q: %v", c.ListenAddr, err)
+	}
+	if c.MaxUploadBytes <= 0 {
+		return errors.New("max upload size must be positive")
+	}
+	if c.MaxWidth < 0 || c.MaxHeight < 0 || c.MaxMegapixels < 0 {
+		return errors.New("max width, height and megapixels must not be negative")
+	}
+	if len(c.CORSOrigins) == 0 {
+		return errors.New("at least one CORS origin is required (use * to allow any)")
+	}
+	for _, origin := range c.CORSOrigins {
+		if err := validateOrigin(origin); err != nil {
+			return fmt.Errorf("invalid CORS origin %q: %v", origin, err)
+		}
+	}
+	if c.CORSAllowCredentials && slices.Contains(c.CORSOrigins, "*") {
+		return errors.New("CORS credentials cannot be allowed for the * origin; list the allowed origins instead")
+	}
+	if len(c.CORSMethods) == 0 {
+		return errors.New("at least one CORS method is required")
+	}
+	if c.CORSMaxAge < 0 {
+		return errors.New("CORS max age must not be negative")
+	}
+	for _, timeout := range []time.Duration{c.ReadTimeout, c.WriteTimeout, c.IdleTimeout, c.ReadHeaderTimeout, c.ShutdownTimeout} {
+		if timeout < 0 {
+			return errors.New("timeouts must not be negative")
+		}
+	}
+	if c.DefaultJPEGQuality < 1 || c.DefaultJPEGQuality > 100 {
+		return fmt.Errorf("default JPEG quality must be between 1 and 100, got %d", c.DefaultJPEGQuality)
+	}
+	if c.MaxConcurrentJobs < 0 || c.MaxConcurrentMegapixels < 0 || c.QueueDepth < 0 || c.QueueTimeout < 0 {
+		return errors.New("concurrency limits, queue depth and queue timeout must not be negative")
+	}
+	if !slices.Contains(logging.Levels, c.LogLevel) {
+		return fmt.Errorf("invalid log level %q. Supported: %s", c.LogLevel, strings.Join(logging.Levels, ", "))
+	}
+	if !slices.Contains(logging.Formats, c.LogFormat) {
+		return fmt.Errorf("invalid log format %q. Supported: %s", c.LogFormat, strings.Join(logging.Formats, ", "))
+	}
+	if c.RateLimit < 0 {
+		return errors.New("rate limit must not be negative")
+	}
+	if c.RateLimit > 0 && c.RateBurst < 1 {
+		return errors.New("rate burst must be at least 1")
+	}
+	for _, proxy := range c.TrustedProxies {
+		if _, err := ratelimit.ParsePrefix(proxy); err != nil {
+			return err
+		}
+	}
+	for _, endpoint := range c.EnabledEndpoints {
+		if !slices.Contains(Endpoints, endpoint) {
+			return fmt.Errorf("unknown endpoint %q. Supported: %s", endpoint, strings.Join(Endpoints, ", "))
+		}
+	}
+	return nil
+}
+
+// validateOrigin checks that origin is "*" or a scheme://host[:port] origin, where the
+// host may start with a "*." wildcard label.
+func validateOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+	u, err := url.Parse(strings.Replace(origin, "://*.", "://wildcard.", 1))
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return errors.New("must be of the form scheme://host[:port]")
+	}
+	if strings.Contains(u.Host, "*") {
+		return errors.New("a wildcard is only allowed as the first label of the host")
+	}
+	return nil
+}
+
+// EndpointEnabled reports whether the named endpoint should be served.
+func (c Config) EndpointEnabled(name string) bool {
+	return slices.Contains(c.EnabledEndpoints, name)
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "config.yaml")
+	os.WriteFile(yamlPath, []byte("listen_addr: \":9000\"\nmax_width: 4000\nwrite_timeout: 2m\nenabled_endpoints: [resize, info]\n"), 0o600)
+	jsonPath := filepath.Join(dir, "config.json")
+	os.WriteFile(jsonPath, []byte(`{"default_jpeg_quality": 90, "cors_origins": ["https://a.example"]}`), 0o600)
+	unknownPath := filepath.Join(dir, "unknown.yaml")
+	os.WriteFile(unknownPath, []byte("listen_port: 9000\n"), 0o600)
+
+	testCases := []struct {
+		name        string
+		args        []string
+		env         map[string]string
+		expectError bool
+		check       func(c Config) bool
+	}{
+		{"Defaults", nil, nil, false, func(c Config) bool {
+			return c.ListenAddr == "0.0.0.0:8080" && c.MaxUploadBytes == 32<<20 && c.DefaultJPEGQuality == 75 && len(c.EnabledEndpoints) == len(Endpoints)
+		}},
+		{"YAML File", []string{"-config", yamlPath}, nil, false, func(c Config) bool {
+			return c.ListenAddr == ":9000" && c.MaxWidth == 4000 && c.WriteTimeout == 2*time.Minute && slices.Equal(c.EnabledEndpoints, []string{"resize", "info"})
+		}},
+		{"JSON File From Env", nil, map[string]string{"IMAGE_SERVICE_CONFIG": jsonPath}, false, func(c Config) bool {
+			return c.DefaultJPEGQuality == 90 && slices.Equal(c.CORSOrigins, []string{"https://a.example"})
+		}},
+		{"Env Overrides File", []string{"-config", yamlPath}, map[string]string{"IMAGE_SERVICE_MAX_WIDTH": "2000"}, false, func(c Config) bool {
+			return c.MaxWidth == 2000 && c.ListenAddr == ":9000"
+		}},
+		{"Flag Overrides Env", []string{"-max-width", "1000", "-cors-origins", "https://a.example, https://b.example"}, map[string]string{"IMAGE_SERVICE_MAX_WIDTH": "2000"}, false, func(c Config) bool {
+			return c.MaxWidth == 1000 && slices.Equal(c.CORSOrigins, []string{"https://a.example", "https://b.example"})
+		}},
+		{"Invalid Duration", []string{"-read-timeout", "soon"}, nil, true, nil},
+		{"Invalid Env Number", nil, map[string]string{"IMAGE_SERVICE_MAX_UPLOAD_BYTES": "lots"}, true, nil},
+		{"Invalid Quality", []string{"-default-jpeg-quality", "101"}, nil, true, nil},
+		{"Invalid Listen Address", []string{"-listen-addr", "8080"}, nil, true, nil},
+		{"Wildcard CORS Origin", []string{"-cors-origins", "https://*.example.com,http://localhost:3000", "-cors-allow-credentials", "true"}, nil, false, func(c Config) bool {
+			return c.CORSAllowCredentials && len(c.CORSOrigins) == 2
+		}},
+		{"Invalid CORS Origin", []string{"-cors-origins", "example.com"}, nil, true, nil},
+		{"CORS Origin With Path", []string{"-cors-origins", "https://example.com/app"}, nil, true, nil},
+		{"Misplaced CORS Wildcard", []string{"-cors-origins", "https://app.*.example.com"}, nil, true, nil},
+		{"CORS Credentials With Any Origin", []string{"-cors-allow-credentials", "true"}, nil, true, nil},
+		{"Rate Limit", []string{"-rate-limit", "0.5", "-rate-burst", "3", "-trusted-proxies", "10.0.0.0/8, 192.168.1.1"}, nil, false, func(c Config) bool {
+			return c.RateLimit == 0.5 && c.RateBurst == 3 && slices.Equal(c.TrustedProxies, []string{"10.0.0.0/8", "192.168.1.1"})
+		}},
+		{"Invalid Rate Burst", []string{"-rate-limit", "10", "-rate-burst", "0"}, nil, true, nil},
+		{"Invalid Trusted Proxy", []string{"-trusted-proxies", "proxy.local"}, nil, true, nil},
+		{"Text Logs", nil, map[string]string{"IMAGE_SERVICE_LOG_LEVEL": "debug", "IMAGE_SERVICE_LOG_FORMAT": "text"}, false, func(c Config) bool {
+			return c.LogLevel == "debug" && c.LogFormat == "text"
+		}},
+		{"Invalid Log Level", []string{"-log-level", "verbose"}, nil, true, nil},
+		{"Invalid Log Format", []string{"-log-format", "xml"}, nil, true, nil},
+		{"Unknown Endpoint", []string{"-enabled-endpoints", "resize,explode"}, nil, true, nil},
+		{"Unknown File Key", []string{"-config", unknownPath}, nil, true, nil},
+		{"Missing File", []string{"-config", filepath.Join(dir, "missing.yaml")}, nil, true, nil},
+		{"Unknown Flag", []string{"-port", "8080"}, nil, true, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lookupEnv := func(key string) (string, bool) {
+				v, ok := tc.env[key]
+				return v, ok
+			}
+			cfg, err := load(tc.args, lookupEnv, io.Discard)
+			if tc.expectError {
+				if err == nil {
+					t.Fatalf("Expected an error, got config %+v", cfg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !tc.check(cfg) {
+				t.Errorf("Unexpected config: %+v", cfg)
+			}
+		})
+	}
+}
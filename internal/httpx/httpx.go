@@ -0,0 +1,67 @@
+// Package httpx holds the request and response wrappers shared by the middlewares that
+// measure requests.
+package httpx
+
+import (
+	"io"
+	"net/http"
+)
+
+// CountingReader counts the bytes read from a request body.
+type CountingReader struct {
+	io.ReadCloser
+	// N is the number of bytes read so far.
+	N int64
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.N += int64(n)
+	return n, err
+}
+
+// ResponseRecorder captures the status code and body size of a response while passing
+// it through. It unwraps to the ResponseWriter it wraps, so http.ResponseController
+// still reaches optional interfaces such as http.Flusher through any number of
+// recorders.
+type ResponseRecorder struct {
+	http.ResponseWriter
+	// Status is the status code sent, http.StatusOK until one is written.
+	Status int
+	// Bytes is the number of body bytes written so far.
+	Bytes int64
+
+	wroteHeader bool
+}
+
+// NewResponseRecorder returns a recorder for w.
+func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
+	return &ResponseRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (r *ResponseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.Status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *ResponseRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(p)
+	r.Bytes += int64(n)
+	return n, err
+}
+
+// Flush sends buffered data to the client, for handlers that check for http.Flusher
+// directly rather than through http.ResponseController.
+func (r *ResponseRecorder) Flush() {
+	r.wroteHeader = true
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+// Unwrap returns the wrapped ResponseWriter, for http.ResponseController.
+func (r *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,69 @@
+package httpx
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCountingReader(t *testing.T) {
+	body := &CountingReader{ReadCloser: io.NopCloser(strings.NewReader("12345678"))}
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		t.Fatalf("Failed to read body: %v", err)
+	}
+	if body.N != 8 {
+		t.Errorf("Expected 8 bytes read, got %d", body.N)
+	}
+}
+
+func TestResponseRecorder(t *testing.T) {
+	testCases := []struct {
+		name           string
+		handler        http.HandlerFunc
+		expectedStatus int
+		expectedBytes  int64
+		expectFlushed  bool
+	}{
+		{"Implicit OK", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("hello")) }, http.StatusOK, 5, false},
+		{"Explicit Status", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("tea"))
+		}, http.StatusTeapot, 3, false},
+		{"Status After Write Ignored", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+			w.WriteHeader(http.StatusNotFound)
+		}, http.StatusOK, 2, false},
+		{"Flush Through Controller", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("a"))
+			if err := http.NewResponseController(w).Flush(); err != nil {
+				t.Errorf("Expected flushing to be supported, got %v", err)
+			}
+		}, http.StatusOK, 1, true},
+		{"Flush Through Flusher", func(w http.ResponseWriter, r *http.Request) {
+			w.(http.Flusher).Flush()
+		}, http.StatusOK, 0, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			// Stack recorders as the middleware chain does.
+			outer := NewResponseRecorder(recorder)
+			inner := NewResponseRecorder(outer)
+
+			tc.handler(inner, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			for _, rw := range []*ResponseRecorder{outer, inner} {
+				if rw.Status != tc.expectedStatus || rw.Bytes != tc.expectedBytes {
+					t.Errorf("Expected status %d and %d bytes, got %d and %d", tc.expectedStatus, tc.expectedBytes, rw.Status, rw.Bytes)
+				}
+			}
+			if recorder.Flushed != tc.expectFlushed {
+				t.Errorf("Expected flushed %v, got %v", tc.expectFlushed, recorder.Flushed)
+			}
+		})
+	}
+}
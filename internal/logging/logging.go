@@ -0,0 +1,193 @@
+// Package logging sets up structured logging and attaches request fields, such as the
+// request ID, to every log line written while serving a request.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go-image-processing-service/internal/httpx"
+)
+
+// RequestIDHeader is the header carrying the request ID, in requests and responses.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength caps the length of a request ID accepted from a client.
+const maxRequestIDLength = 128
+
+// Levels and Formats list the supported log levels and formats.
+var (
+	Levels  = []string{"debug", "info", "warn", "error"}
+	Formats = []string{"json", "text"}
+)
+
+// New returns a logger writing to w at the given level ("debug", "info", "warn" or
+// "error") in the given format ("json" or "text").
+func New(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q. Supported: %s", level, strings.Join(Levels, ", "))
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q. Supported: %s", format, strings.Join(Formats, ", "))
+	}
+}
+
+// requestLog holds the logger of a request and the fields added while serving it.
+type requestLog struct {
+	logger *slog.Logger
+	id     string
+
+	mu     sync.Mutex
+	fields []any
+}
+
+// current returns the request logger with the fields added so far.
+func (rl *requestLog) current() *slog.Logger {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.logger.With(rl.fields...)
+}
+
+// contextKey is the request context key of the requestLog.
+type contextKey struct{}
+
+// FromContext returns the logger of the request served with ctx, carrying the request
+// fields added so far. Outside a request it returns the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	rl, ok := ctx.Value(contextKey{}).(*requestLog)
+	if !ok {
+		return slog.Default()
+	}
+	return rl.current()
+}
+
+// AddFields attaches key-value pairs, as accepted by slog, to the log lines written for
+// the request of ctx from now on, including its completion line. It does nothing
+// outside a request.
+func AddFields(ctx context.Context, args ...any) {
+	if ctx == nil {
+		return
+	}
+	rl, ok := ctx.Value(contextKey{}).(*requestLog)
+	if !ok {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.fields = append(rl.fields, args...)
+}
+
+// RequestID returns the ID of the request served with ctx, or "" outside a request.
+func RequestID(ctx context.Context) string {
+	if rl, ok := ctx.Value(contextKey{}).(*requestLog); ok {
+		return rl.id
+	}
+	return ""
+}
+
+// Middleware assigns every request an ID, taken from its X-Request-ID header when it is
+// a reasonable one and generated otherwise, and echoes it in the response. Log lines
+// written through FromContext while serving the request carry the ID, method, path,
+// endpoint and query parameters; redact names query parameters whose values must not be
+// logged. A completion line with the status, duration and body sizes ends each request.
+func Middleware(logger *slog.Logger, redact []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		endpoint, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/"), "/")
+		rl := &requestLog{
+			id: id,
+			logger: logger.With(
+				"request_id", id,
+				"method", r.Method,
+				"path", r.URL.Path,
+				"endpoint", endpoint,
+				"params", redactedQuery(r, redact),
+				"remote_addr", r.RemoteAddr,
+			),
+		}
+
+		body := &httpx.CountingReader{ReadCloser: r.Body}
+		r.Body = body
+		rw := httpx.NewResponseRecorder(w)
+
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), contextKey{}, rl)))
+
+		level := slog.LevelInfo
+		if rw.Status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		rl.current().Log(r.Context(), level, "Request completed",
+			"status", rw.Status,
+			"duration_ms", milliseconds(time.Since(start)),
+			"bytes_in", body.N,
+			"bytes_out", rw.Bytes,
+		)
+	})
+}
+
+// milliseconds converts d to fractional milliseconds for logging.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Duration returns the key-value pair logging d in milliseconds under key + "_ms".
+func Duration(key string, d time.Duration) slog.Attr {
+	return slog.Float64(key+"_ms", milliseconds(d))
+}
+
+// validRequestID reports whether a client-supplied request ID can be used as is: it
+// must be non-empty, short and made of letters, digits and -._:
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID generates a random 128-bit request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// redactedQuery returns the query string of r with the values of the redact parameters
+// replaced.
+func redactedQuery(r *http.Request, redact []string) string {
+	query := r.URL.Query()
+	for _, name := range redact {
+		if query.Has(name) {
+			query.Set(name, "REDACTED")
+		}
+	}
+	return query.Encode()
+}
@@ -0,0 +1,105 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	testCases := []struct {
+		name        string
+		level       string
+		format      string
+		expectError bool
+	}{
+		{"JSON Info", "info", "json", false},
+		{"Text Debug", "debug", "text", false},
+		{"Invalid Level", "verbose", "json", true},
+		{"Invalid Format", "info", "xml", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(new(bytes.Buffer), tc.level, tc.format)
+			if (err != nil) != tc.expectError {
+				t.Errorf("Expected error %v, got %v", tc.expectError, err)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	testCases := []struct {
+		name          string
+		url           string
+		requestID     string
+		expectedID    string
+		expectedParam string
+	}{
+		{"Accepts Request ID", "/api/resize?width=10", "abc-123", "abc-123", "width=10"},
+		{"Generates Request ID", "/api/resize", "", "", ""},
+		{"Replaces Invalid Request ID", "/api/resize", "bad id\n", "", ""},
+		{"Redacts API Key", "/api/resize?api_key=secret&width=10", "", "", "api_key=REDACTED&width=10"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out := new(bytes.Buffer)
+			logger, _ := New(out, "debug", "json")
+			handler := Middleware(logger, []string{"api_key"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				AddFields(r.Context(), "source_width", 10)
+				FromContext(r.Context()).Info("Handling")
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte("done"))
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, tc.url, strings.NewReader("body"))
+			if tc.requestID != "" {
+				req.Header.Set(RequestIDHeader, tc.requestID)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			id := recorder.Header().Get(RequestIDHeader)
+			if tc.expectedID != "" && id != tc.expectedID {
+				t.Errorf("Expected request ID %q, got %q", tc.expectedID, id)
+			}
+			if tc.expectedID == "" && len(id) != 32 {
+				t.Errorf("Expected a generated request ID, got %q", id)
+			}
+
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("Expected 2 log lines, got %d: %s", len(lines), out.String())
+			}
+			for i, line := range lines {
+				var entry map[string]any
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("Expected JSON log lines, got %q", line)
+				}
+				if entry["request_id"] != id || entry["endpoint"] != "resize" || entry["source_width"] != float64(10) {
+					t.Errorf("Expected request fields on line %d, got %s", i+1, line)
+				}
+				if tc.expectedParam != "" && entry["params"] != tc.expectedParam {
+					t.Errorf("Expected params %q, got %v", tc.expectedParam, entry["params"])
+				}
+				if strings.Contains(line, "secret") {
+					t.Errorf("Expected the API key to be redacted, got %s", line)
+				}
+			}
+
+			var completed map[string]any
+			json.Unmarshal([]byte(lines[1]), &completed)
+			if completed["msg"] != "Request completed" || completed["status"] != float64(http.StatusCreated) ||
+				completed["bytes_in"] != float64(4) || completed["bytes_out"] != float64(4) || completed["duration_ms"] == nil {
+				t.Errorf("Unexpected completion line: %s", lines[1])
+			}
+		})
+	}
+}
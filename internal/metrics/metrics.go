@@ -0,0 +1,142 @@
+// Package metrics exposes the service metrics in the Prometheus format.
+package metrics
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"go-image-processing-service/internal/httpx"
+)
+
+// namespace prefixes every metric name.
+const namespace = "image_service"
+
+// sizeBuckets are the histogram buckets for request and response sizes, from 1 KiB to
+// 256 MiB.
+var sizeBuckets = prometheus.ExponentialBuckets(1024, 4, 10)
+
+// Metrics collects the metrics of the service in its own registry.
+type Metrics struct {
+	registry *prometheus.Registry
+	// endpoints are the names used as the endpoint label; other paths are labeled "other".
+	endpoints []string
+
+	requests      *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	inFlight      prometheus.Gauge
+	requestBytes  *prometheus.HistogramVec
+	responseBytes *prometheus.HistogramVec
+	stageDuration *prometheus.HistogramVec
+	sourceFormats *prometheus.CounterVec
+}
+
+// New creates the metrics, including the Go runtime and process metrics. endpoints
+// lists the names of the endpoints under /api/ that get their own endpoint label.
+func New(endpoints []string) *Metrics {
+	m := &Metrics{
+		registry:  prometheus.NewRegistry(),
+		endpoints: endpoints,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by endpoint and status code.",
+		}, []string{"endpoint", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by endpoint and status code.",
+			Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		}, []string{"endpoint", "status"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "http_requests_in_flight",
+			Help:      "HTTP requests being served.",
+		}),
+		requestBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_size_bytes",
+			Help:      "Size of request bodies by endpoint.",
+			Buckets:   sizeBuckets,
+		}, []string{"endpoint"}),
+		responseBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_response_size_bytes",
+			Help:      "Size of response bodies by endpoint.",
+			Buckets:   sizeBuckets,
+		}, []string{"endpoint"}),
+		stageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "image_stage_duration_seconds",
+			Help:      "Time spent decoding, transforming and encoding images.",
+			Buckets:   []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		}, []string{"stage"}),
+		sourceFormats: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "source_images_total",
+			Help:      "Decoded uploads by source format.",
+		}, []string{"format"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests, m.duration, m.inFlight, m.requestBytes, m.responseBytes,
+		m.stageDuration, m.sourceFormats,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ObserveStage records the duration of an image processing stage: decode, transform
+// or encode.
+func (m *Metrics) ObserveStage(stage string, d time.Duration) {
+	m.stageDuration.WithLabelValues(stage).Observe(d.Seconds())
+}
+
+// ObserveSourceFormat counts a decoded upload of the given format.
+func (m *Metrics) ObserveSourceFormat(format string) {
+	m.sourceFormats.WithLabelValues(format).Inc()
+}
+
+// endpoint returns the endpoint label of a request path. Unknown paths share the
+// "other" label so that arbitrary URLs cannot create new series.
+func (m *Metrics) endpoint(path string) string {
+	name, _, _ := strings.Cut(strings.TrimPrefix(path, "/api/"), "/")
+	if name == "health" || slices.Contains(m.endpoints, name) {
+		return name
+	}
+	return "other"
+}
+
+// Middleware records the request metrics of every request passed to next.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+
+		body := &httpx.CountingReader{ReadCloser: r.Body}
+		r.Body = body
+		rw := httpx.NewResponseRecorder(w)
+
+		next.ServeHTTP(rw, r)
+
+		endpoint := m.endpoint(r.URL.Path)
+		status := strconv.Itoa(rw.Status)
+		m.requests.WithLabelValues(endpoint, status).Inc()
+		m.duration.WithLabelValues(endpoint, status).Observe(time.Since(start).Seconds())
+		m.requestBytes.WithLabelValues(endpoint).Observe(float64(body.N))
+		m.responseBytes.WithLabelValues(endpoint).Observe(float64(rw.Bytes))
+	})
+}
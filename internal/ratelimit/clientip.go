@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientIP resolves the address of the client behind a request. X-Forwarded-For is only
+// honored when the request comes from a trusted proxy, since anyone else can forge it.
+type ClientIP struct {
+	trusted []netip.Prefix
+}
+
+// NewClientIP returns a ClientIP trusting the given proxies, each an IP address or a
+// CIDR range.
+func NewClientIP(trustedProxies []string) (*ClientIP, error) {
+	c := &ClientIP{}
+	for _, proxy := range trustedProxies {
+		prefix, err := ParsePrefix(proxy)
+		if err != nil {
+			return nil, err
+		}
+		c.trusted = append(c.trusted, prefix)
+	}
+	return c, nil
+}
+
+// ParsePrefix parses an IP address or CIDR range; an address is a single-host range.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid proxy range %q: %v", s, err)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid proxy address %q: %v", s, err)
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+// isTrusted reports whether addr is one of the trusted proxies.
+func (c *ClientIP) isTrusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range c.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the client address of r. When the peer is a trusted proxy, the
+// X-Forwarded-For chain is walked from the right, skipping trusted proxies, and the
+// first other address is the client.
+func (c *ClientIP) Resolve(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !c.isTrusted(peer) {
+		return host
+	}
+
+	client := peer.Unmap()
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// An unparseable entry cannot be trusted; stop at the last good address.
+			break
+		}
+		client = hop.Unmap()
+		if !c.isTrusted(client) {
+			break
+		}
+	}
+	return client.String()
+}
@@ -0,0 +1,103 @@
+// Package ratelimit limits how often each client may call the API, using one token
+// bucket per client.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often buckets that have refilled are dropped from memory.
+const sweepInterval = time.Minute
+
+// Result describes the outcome of a request against a client's bucket.
+type Result struct {
+	// Allowed reports whether the request may proceed.
+	Allowed bool
+	// Limit is the bucket capacity, the most requests that can be made at once.
+	Limit int
+	// Remaining is the number of whole tokens left after the request.
+	Remaining int
+	// RetryAfter is how long a rejected client must wait for a token; 0 when allowed.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// bucket is a token bucket, refilled lazily from the time it was last updated.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Limiter holds a token bucket per client key. Each bucket holds up to burst tokens,
+// refills at rate tokens per second, and every request takes one token.
+type Limiter struct {
+	rate  float64
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewLimiter returns a Limiter allowing rate requests per second per client, with
+// bursts of up to burst requests.
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of the client identified by key.
+func (l *Limiter) Allow(key string) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.burst), updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+
+	result := Result{Limit: l.burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = l.duration(1 - b.tokens)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = l.duration(float64(l.burst) - b.tokens)
+	return result
+}
+
+// duration returns the time it takes to refill the given number of tokens.
+func (l *Limiter) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// sweep drops the buckets that have had time to refill completely, since a new bucket
+// is identical. l.mu must be held.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	full := l.duration(float64(l.burst))
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
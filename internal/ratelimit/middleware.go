@@ -0,0 +1,42 @@
+package ratelimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Middleware limits requests per client before passing them to next. Clients are
+// identified by the string key returns, e.g. their API key or address; requests for
+// which key returns "" are not limited.
+//
+// Every limited response carries X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset (seconds until the bucket is full). Rejected requests get 429 with
+// a Retry-After header.
+func (l *Limiter) Middleware(key func(r *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := key(r)
+		if client == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		result := l.Allow(client)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(seconds(result.Reset)))
+		if !result.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, seconds(result.RetryAfter))))
+			http.Error(w, "rate limit exceeded, retry later", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// seconds rounds d up to whole seconds.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,134 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	limiter := NewLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	testCases := []struct {
+		name              string
+		key               string
+		advance           time.Duration
+		expectedAllowed   bool
+		expectedRemaining int
+		expectedRetry     time.Duration
+	}{
+		{"First Request", "a", 0, true, 2, 0},
+		{"Second Request", "a", 0, true, 1, 0},
+		{"Third Request", "a", 0, true, 0, 0},
+		{"Burst Exhausted", "a", 0, false, 0, 500 * time.Millisecond},
+		{"Other Client Unaffected", "b", 0, true, 2, 0},
+		{"Refilled One Token", "a", 500 * time.Millisecond, true, 0, 0},
+		{"Refill Capped At Burst", "a", time.Hour, true, 2, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			now = now.Add(tc.advance)
+			result := limiter.Allow(tc.key)
+			if result.Allowed != tc.expectedAllowed || result.Remaining != tc.expectedRemaining || result.RetryAfter != tc.expectedRetry {
+				t.Errorf("Expected allowed %v, remaining %d, retry after %v; got %+v", tc.expectedAllowed, tc.expectedRemaining, tc.expectedRetry, result)
+			}
+			if result.Limit != 3 {
+				t.Errorf("Expected limit 3, got %d", result.Limit)
+			}
+		})
+	}
+
+	now = now.Add(time.Hour)
+	limiter.Allow("c")
+	if _, ok := limiter.buckets["a"]; ok {
+		t.Error("Expected refilled buckets to be swept")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	clientIP, err := NewClientIP([]string{"127.0.0.1", "10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		expectedIP   string
+	}{
+		{"Direct Client", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"Untrusted Peer Forwarded For Ignored", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"Trusted Proxy", "127.0.0.1:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"Trusted IPv6 Proxy", "[::1]:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"Spoofed Entries Left Of Client", "127.0.0.1:5000", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"Proxy Chain", "127.0.0.1:5000", []string{"198.51.100.1, 10.1.2.3"}, "198.51.100.1"},
+		{"Multiple Headers", "127.0.0.1:5000", []string{"198.51.100.1", "10.1.2.3"}, "198.51.100.1"},
+		{"Only Proxies", "127.0.0.1:5000", []string{"10.1.2.3"}, "10.1.2.3"},
+		{"Trusted Proxy Without Header", "127.0.0.1:5000", nil, "127.0.0.1"},
+		{"Garbage Entry", "127.0.0.1:5000", []string{"198.51.100.1, not-an-ip"}, "127.0.0.1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for _, v := range tc.forwardedFor {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientIP.Resolve(req); got != tc.expectedIP {
+				t.Errorf("Expected client %s, got %s", tc.expectedIP, got)
+			}
+		})
+	}
+
+	if _, err := NewClientIP([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("Expected an invalid range to be rejected")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	limiter := NewLimiter(1, 2)
+	key := func(r *http.Request) string { return r.Header.Get("X-Client") }
+	handler := limiter.Middleware(key, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+
+	testCases := []struct {
+		name              string
+		client            string
+		expectedStatus    int
+		expectedRemaining string
+	}{
+		{"Unkeyed Request Not Limited", "", http.StatusOK, ""},
+		{"First Request", "a", http.StatusOK, "1"},
+		{"Second Request", "a", http.StatusOK, "0"},
+		{"Limited", "a", http.StatusTooManyRequests, "0"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/resize", nil)
+			req.Header.Set("X-Client", tc.client)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			if recorder.Code != tc.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d", tc.expectedStatus, recorder.Code)
+			}
+			if got := recorder.Header().Get("X-RateLimit-Remaining"); got != tc.expectedRemaining {
+				t.Errorf("Expected X-RateLimit-Remaining %q, got %q", tc.expectedRemaining, got)
+			}
+			if tc.client != "" && recorder.Header().Get("X-RateLimit-Limit") != "2" {
+				t.Errorf("Expected X-RateLimit-Limit 2, got %q", recorder.Header().Get("X-RateLimit-Limit"))
+			}
+			if limited := recorder.Header().Get("Retry-After") != ""; limited != (tc.expectedStatus == http.StatusTooManyRequests) {
+				t.Errorf("Unexpected Retry-After header %q", recorder.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
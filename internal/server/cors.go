@@ -0,0 +1,156 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go-image-processing-service/internal/config"
+)
+
+// corsPolicy decides which browser origins may call the API and answers preflight
+// requests for them.
+type corsPolicy struct {
+	allowAny    bool
+	origins     []string
+	wildcards   []wildcardOrigin
+	credentials bool
+	methods     []string
+	headers     []string // lower-cased for comparison
+	// allowMethods, allowHeaders, exposeHeaders and maxAge are the response header values.
+	allowMethods  string
+	allowHeaders  string
+	exposeHeaders string
+	maxAge        string
+}
+
+// wildcardOrigin matches the subdomains of an origin pattern such as
+// "https://*.example.com": prefix is "https://" and suffix ".example.com".
+type wildcardOrigin struct {
+	prefix, suffix string
+}
+
+// matches reports whether origin is a subdomain allowed by the pattern. The bare domain
+// itself does not match.
+func (w wildcardOrigin) matches(origin string) bool {
+	if len(origin) <= len(w.prefix)+len(w.suffix) || !strings.HasPrefix(origin, w.prefix) || !strings.HasSuffix(origin, w.suffix) {
+		return false
+	}
+	subdomain := origin[len(w.prefix) : len(origin)-len(w.suffix)]
+	return !strings.ContainsAny(subdomain, "/:@")
+}
+
+// newCORSPolicy builds the CORS policy from the configuration.
+func newCORSPolicy(cfg config.Config) corsPolicy {
+	p := corsPolicy{
+		credentials:   cfg.CORSAllowCredentials,
+		methods:       cfg.CORSMethods,
+		allowMethods:  strings.Join(cfg.CORSMethods, ", "),
+		allowHeaders:  strings.Join(cfg.CORSHeaders, ", "),
+		exposeHeaders: strings.Join(cfg.CORSExposeHeaders, ", "),
+	}
+	if cfg.CORSMaxAge > 0 {
+		p.maxAge = strconv.Itoa(int(cfg.CORSMaxAge.Seconds()))
+	}
+	for _, header := range cfg.CORSHeaders {
+		p.headers = append(p.headers, strings.ToLower(header))
+	}
+	for _, origin := range cfg.CORSOrigins {
+		origin = strings.ToLower(origin)
+		switch {
+		case origin == "*":
+			p.allowAny = true
+		case strings.Contains(origin, "://*."):
+			scheme, domain, _ := strings.Cut(origin, "://*.")
+			p.wildcards = append(p.wildcards, wildcardOrigin{prefix: scheme + "://", suffix: "." + domain})
+		default:
+			p.origins = append(p.origins, origin)
+		}
+	}
+	return p
+}
+
+// allowsOrigin reports whether requests from origin may read API responses.
+func (p corsPolicy) allowsOrigin(origin string) bool {
+	if p.allowAny {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if slices.Contains(p.origins, origin) {
+		return true
+	}
+	for _, w := range p.wildcards {
+		if w.matches(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHeaders reports whether every header of an Access-Control-Request-Headers value
+// is allowed.
+func (p corsPolicy) allowsHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.ToLower(strings.TrimSpace(header))
+		if header != "" && !slices.Contains(p.headers, header) {
+			return false
+		}
+	}
+	return true
+}
+
+// middleware applies the policy. Responses to allowed origins carry the CORS headers;
+// preflight requests are answered directly, with 204 when the origin, method and
+// headers are allowed and 403 otherwise. Other requests are always passed on, since
+// it is the browser that withholds responses from disallowed origins.
+func (p corsPolicy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		// The response depends on the origin unless every origin gets the same answer.
+		echoOrigin := !p.allowAny || p.credentials
+		if echoOrigin {
+			w.Header().Add("Vary", "Origin")
+		}
+
+		preflight := r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			if !p.allowsOrigin(origin) ||
+				!slices.Contains(p.methods, r.Header.Get("Access-Control-Request-Method")) ||
+				!p.allowsHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+				http.Error(w, "CORS preflight request not allowed", http.StatusForbidden)
+				return
+			}
+		}
+
+		if origin != "" && p.allowsOrigin(origin) {
+			if echoOrigin {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			}
+			if p.credentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			if !preflight && p.exposeHeaders != "" {
+				w.Header().Set("Access-Control-Expose-Headers", p.exposeHeaders)
+			}
+		}
+
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", p.allowMethods)
+			if p.allowHeaders != "" {
+				w.Header().Set("Access-Control-Allow-Headers", p.allowHeaders)
+			}
+			if p.maxAge != "" {
+				w.Header().Set("Access-Control-Max-Age", p.maxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,64 +1,236 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"go-image-processing-service/internal/api"
+	"go-image-processing-service/internal/auth"
+	"go-image-processing-service/internal/config"
+	"go-image-processing-service/internal/logging"
+	"go-image-processing-service/internal/metrics"
+	"go-image-processing-service/internal/ratelimit"
 )
 
+// endpointHandlers maps the endpoint names of config.Endpoints to their handlers.
+var endpointHandlers = map[string]http.HandlerFunc{
+	"resize":    api.ResizeHandler,
+	"compress":  api.CompressHandler,
+	"convert":   api.ConvertHandler,
+	"flip":      api.FlipHandler,
+	"rotate":    api.RotateHandler,
+	"crop":      api.CropHandler,
+	"smartcrop": api.SmartCropHandler,
+	"adjust":    api.AdjustHandler,
+	"blur":      api.BlurHandler,
+	"sharpen":   api.SharpenHandler,
+	"watermark": api.WatermarkHandler,
+	"process":   api.ProcessHandler,
+	"info":      api.InfoHandler,
+}
+
 // Server holds the dependencies and configuration for our HTTP server.
 type Server struct {
-	port string
+	config     config.Config
+	httpServer *http.Server
+	// auth checks API keys; it is nil when no API keys file is configured.
+	auth *auth.Authenticator
+	// limiter rate limits clients; it is nil when rate limiting is disabled.
+	limiter  *ratelimit.Limiter
+	clientIP *ratelimit.ClientIP
+	// metrics collects the Prometheus metrics; it is nil when metrics are disabled.
+	metrics *metrics.Metrics
+	logger  *slog.Logger
 }
 
-// New creates and returns a new Server instance, configured to listen on the given port.
-func New(port string) *Server {
-	return &Server{
-		port: port,
+// New creates and returns a new Server instance using the given configuration,
+// which is expected to have been validated by config.Load. It fails if the API keys
+// file cannot be loaded.
+func New(cfg config.Config) (*Server, error) {
+	logger, err := logging.New(os.Stderr, cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		config: cfg,
+		logger: logger,
+	}
+	if cfg.APIKeysFile != "" {
+		store, err := auth.LoadFile(cfg.APIKeysFile, config.Endpoints)
+		if err != nil {
+			return nil, err
+		}
+		s.auth = auth.NewAuthenticator(store, "/api/health")
+	}
+	if cfg.MetricsEnabled {
+		s.metrics = metrics.New(config.Endpoints)
 	}
+	if cfg.RateLimit > 0 {
+		clientIP, err := ratelimit.NewClientIP(cfg.TrustedProxies)
+		if err != nil {
+			return nil, err
+		}
+		s.limiter = ratelimit.NewLimiter(cfg.RateLimit, cfg.RateBurst)
+		s.clientIP = clientIP
+	}
+	s.httpServer = &http.Server{
+		Addr:              cfg.ListenAddr,
+		Handler:           s.Handler(),
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	return s, nil
 }
 
-// Start initializes all server routes and begins listening for incoming HTTP requests.
-// It will block until the server is stopped or a fatal error occurs.
-func (s *Server) Start() {
+// Handler builds the routes for the enabled endpoints, wrapped in the server middleware.
+func (s *Server) Handler() http.Handler {
 	// Create a new mux (router)
 	rootMux := http.NewServeMux()
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/health", api.HealthCheckHandler)
-	mux.HandleFunc("/resize", api.ResizeHandler)
-	mux.HandleFunc("/compress", api.CompressHandler)
-	mux.HandleFunc("/convert", api.ConvertHandler)
-	mux.HandleFunc("/flip", api.FlipHandler)
-	mux.HandleFunc("/rotate", api.RotateHandler)
-	mux.HandleFunc("/crop", api.CropHandler)
+	for _, name := range config.Endpoints {
+		if s.config.EndpointEnabled(name) {
+			mux.HandleFunc("/"+name, endpointHandlers[name])
+		}
+	}
 
-	rootMux.Handle("/api/", http.StripPrefix("/api", mux))
+	// Admit bounds the image work running at once; the health check does no image work.
+	rootMux.Handle("/api/", http.StripPrefix("/api", api.Admit(mux)))
 
-	// Wrap the mux with a CORS middleware
-	h := corsMiddleware(rootMux)
+	var handler http.Handler = rootMux
+	if s.auth != nil {
+		handler = s.auth.Middleware(handler)
+	}
+	// Rate limiting comes before authentication so that rejected requests do not count
+	// against quotas and guessing keys is limited too.
+	if s.limiter != nil {
+		handler = s.limiter.Middleware(s.rateLimitKey, handler)
+	}
 
-	fmt.Printf("Starting server on http://localhost:%s\n", s.port)
-	log.Fatal(http.ListenAndServe("0.0.0.0:"+s.port, h))
+	// Wrap the mux with the body size limit and CORS middleware
+	handler = newCORSPolicy(s.config).middleware(maxBytesMiddleware(s.config.MaxUploadBytes, handler))
+	// Request IDs and request logging come first, so that rejected requests are logged too.
+	if s.metrics == nil {
+		return logging.Middleware(s.logger, []string{auth.QueryParam}, handler)
+	}
+
+	// The metrics endpoint is served outside the API middleware, so scrapers need no
+	// API key and are not rate limited.
+	outer := http.NewServeMux()
+	outer.Handle("/metrics", s.metrics.Handler())
+	outer.Handle("/", logging.Middleware(s.logger, []string{auth.QueryParam}, s.metrics.Middleware(handler)))
+	return outer
 }
 
-// corsMiddleware is a simple middleware to handle CORS.
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// For development, we can allow any origin.
-		// For production, you would want to restrict this to your frontend's domain.
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-
-		// Handle pre-flight requests
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
+// Start listens on the configured address and serves requests until the process
+// receives SIGINT or SIGTERM. It then stops accepting connections and waits up to the
+// configured shutdown timeout for in-flight requests to finish. The server logger
+// becomes the default logger of the process.
+func (s *Server) Start() error {
+	slog.SetDefault(s.logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	listener, err := net.Listen("tcp", s.config.ListenAddr)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("Starting server", "addr", listener.Addr().String())
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	// A second signal kills the process without waiting.
+	stop()
+
+	s.logger.Info("Shutting down, waiting for in-flight requests", "timeout", s.config.ShutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("graceful shutdown failed: %v", err)
+	}
+	return <-serveErr
+}
+
+// Serve accepts connections on listener until Shutdown is called, in which case it
+// returns nil.
+func (s *Server) Serve(listener net.Listener) error {
+	api.Configure(api.Settings{
+		MaxUploadBytes:          s.config.MaxUploadBytes,
+		MaxWidth:                s.config.MaxWidth,
+		MaxHeight:               s.config.MaxHeight,
+		MaxMegapixels:           s.config.MaxMegapixels,
+		DefaultJPEGQuality:      s.config.DefaultJPEGQuality,
+		MaxConcurrentJobs:       s.config.MaxConcurrentJobs,
+		MaxConcurrentMegapixels: s.config.MaxConcurrentMegapixels,
+		QueueDepth:              s.config.QueueDepth,
+		QueueTimeout:            s.config.QueueTimeout,
+		Recorder:                s.recorder(),
+	})
+
+	if err := s.httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// recorder returns the api.Recorder receiving the image work measurements, if any.
+func (s *Server) recorder() api.Recorder {
+	if s.metrics == nil {
+		return nil
+	}
+	return s.metrics
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests to finish.
+// If ctx expires first, the remaining connections are closed and ctx's error is
+// returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		s.httpServer.Close()
+		return err
+	}
+	return nil
+}
+
+// rateLimitKey identifies the client of a request for rate limiting: by API key when it
+// presents a valid one, by address otherwise. The health check is not limited.
+func (s *Server) rateLimitKey(r *http.Request) string {
+	if r.URL.Path == "/api/health" {
+		return ""
+	}
+	if s.auth != nil {
+		if key, ok := s.auth.Identify(r); ok {
+			return "key:" + key.Name
 		}
+	}
+	return "ip:" + s.clientIP.Resolve(r)
+}
 
+// maxBytesMiddleware caps request bodies at limit bytes. Reading past the limit fails
+// with an *http.MaxBytesError, which the API handlers answer with 413.
+func maxBytesMiddleware(limit int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
 		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go-image-processing-service/internal/config"
+)
+
+// startTestServer serves a server with the given configuration on a random local port
+// and returns it with its base URL and the result of Serve.
+func startTestServer(t *testing.T, cfg config.Config) (*Server, string, <-chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(listener)
+	}()
+	return srv, "http://" + listener.Addr().String(), serveErr
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	srv, baseURL, serveErr := startTestServer(t, config.Default())
+
+	// Stream the request body so the request is still in flight when shutdown starts.
+	body, bodyWriter := io.Pipe()
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Post(baseURL+"/api/info", "multipart/form-data; boundary=x", body)
+		if err != nil {
+			t.Errorf("Request failed: %v", err)
+			close(responses)
+			return
+		}
+		responses <- resp
+	}()
+	io.WriteString(bodyWriter, "--x\r\n")
+	time.Sleep(100 * time.Millisecond)
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- srv.Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned before the in-flight request finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	io.WriteString(bodyWriter, "Content-Disposition: form-data; name=\"image\"\r\n\r\nnot an image\r\n--x--\r\n")
+	bodyWriter.Close()
+
+	resp, ok := <-responses
+	if !ok {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected the in-flight request to complete with status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Unexpected shutdown error: %v", err)
+	}
+	if err := <-serveErr; err != nil {
+		t.Errorf("Expected Serve to return nil after shutdown, got %v", err)
+	}
+	if _, err := http.Get(baseURL + "/api/health"); err == nil {
+		t.Error("Expected requests to fail after shutdown")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	srv, baseURL, serveErr := startTestServer(t, config.Default())
+
+	body, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+	go http.Post(baseURL+"/api/info", "multipart/form-data; boundary=x", body)
+	io.WriteString(bodyWriter, "--x\r\n")
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if err := <-serveErr; err != nil {
+		t.Errorf("Expected Serve to return nil after shutdown, got %v", err)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	restricted := config.Default()
+	restricted.CORSOrigins = []string{"https://app.example.com", "https://*.example.org"}
+	restricted.CORSAllowCredentials = true
+	restricted.CORSMethods = []string{"GET", "POST"}
+	restricted.CORSHeaders = []string{"Content-Type", "Authorization"}
+	restricted.CORSMaxAge = time.Hour
+
+	testCases := []struct {
+		name              string
+		config            config.Config
+		method            string
+		headers           map[string]string
+		expectedStatus    int
+		expectedOrigin    string
+		expectedVary      bool
+		expectedMaxAge    string
+		expectCredentials bool
+	}{
+		{"Any Origin", config.Default(), http.MethodGet, map[string]string{"Origin": "https://x.test"}, http.StatusOK, "*", false, "", false},
+		{"Any Origin Preflight", config.Default(), http.MethodOptions, map[string]string{"Origin": "https://x.test", "Access-Control-Request-Method": "POST"}, http.StatusNoContent, "*", false, "600", false},
+		{"Exact Origin", restricted, http.MethodGet, map[string]string{"Origin": "https://app.example.com"}, http.StatusOK, "https://app.example.com", true, "", true},
+		{"Wildcard Subdomain", restricted, http.MethodGet, map[string]string{"Origin": "https://cdn.eu.example.org"}, http.StatusOK, "https://cdn.eu.example.org", true, "", true},
+		{"Wildcard Excludes Bare Domain", restricted, http.MethodGet, map[string]string{"Origin": "https://example.org"}, http.StatusOK, "", true, "", false},
+		{"Wildcard Checks Scheme", restricted, http.MethodGet, map[string]string{"Origin": "http://cdn.example.org"}, http.StatusOK, "", true, "", false},
+		{"Disallowed Origin", restricted, http.MethodGet, map[string]string{"Origin": "https://evil.test"}, http.StatusOK, "", true, "", false},
+		{"No Origin", restricted, http.MethodGet, nil, http.StatusOK, "", true, "", false},
+		{"Allowed Preflight", restricted, http.MethodOptions, map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "POST", "Access-Control-Request-Headers": "content-type, authorization"}, http.StatusNoContent, "https://app.example.com", true, "3600", true},
+		{"Preflight From Disallowed Origin", restricted, http.MethodOptions, map[string]string{"Origin": "https://evil.test", "Access-Control-Request-Method": "POST"}, http.StatusForbidden, "", true, "", false},
+		{"Preflight With Disallowed Method", restricted, http.MethodOptions, map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "DELETE"}, http.StatusForbidden, "", true, "", false},
+		{"Preflight With Disallowed Header", restricted, http.MethodOptions, map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "POST", "Access-Control-Request-Headers": "X-Secret"}, http.StatusForbidden, "", true, "", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/api/health", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			srv, err := New(tc.config)
+			if err != nil {
+				t.Fatalf("Could not create server: %v", err)
+			}
+			recorder := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(recorder, req)
+
+			if recorder.Code != tc.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d", tc.expectedStatus, recorder.Code)
+			}
+			header := recorder.Header()
+			if got := header.Get("Access-Control-Allow-Origin"); got != tc.expectedOrigin {
+				t.Errorf("Expected Access-Control-Allow-Origin %q, got %q", tc.expectedOrigin, got)
+			}
+			if got := slices.Contains(header.Values("Vary"), "Origin"); got != tc.expectedVary {
+				t.Errorf("Expected Vary: Origin %v, got %v", tc.expectedVary, got)
+			}
+			if got := header.Get("Access-Control-Max-Age"); got != tc.expectedMaxAge {
+				t.Errorf("Expected Access-Control-Max-Age %q, got %q", tc.expectedMaxAge, got)
+			}
+			if got := header.Get("Access-Control-Allow-Credentials") == "true"; got != tc.expectCredentials {
+				t.Errorf("Expected credentials allowed %v, got %v", tc.expectCredentials, got)
+			}
+		})
+	}
+}
+
+func TestUploadLimit(t *testing.T) {
+	cfg := config.Default()
+	cfg.MaxUploadBytes = 4096
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	handler := srv.Handler()
+
+	testCases := []struct {
+		name           string
+		path           string
+		size           int
+		expectedStatus int
+	}{
+		{"Decoding Handler Within Limit", "/api/resize?width=5", 100, http.StatusBadRequest},
+		{"Decoding Handler Over Limit", "/api/resize?width=5", 8192, http.StatusRequestEntityTooLarge},
+		{"Convert Over Limit", "/api/convert?format=png", 8192, http.StatusRequestEntityTooLarge},
+		{"Info Over Limit", "/api/info", 8192, http.StatusRequestEntityTooLarge},
+		{"Pipeline Over Limit", "/api/process?ops=flip:horizontal", 8192, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			part, _ := writer.CreateFormFile("image", "test.png")
+			part.Write(bytes.Repeat([]byte{'x'}, tc.size))
+			writer.Close()
+			req := httptest.NewRequest(http.MethodPost, tc.path, body)
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			if recorder.Code != tc.expectedStatus {
+				t.Errorf("Expected status code %d, got %d: %s", tc.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestRateLimiting(t *testing.T) {
+	cfg := config.Default()
+	cfg.RateLimit = 1
+	cfg.RateBurst = 1
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	handler := srv.Handler()
+
+	testCases := []struct {
+		name           string
+		path           string
+		remoteAddr     string
+		forwardedFor   string
+		expectedStatus int
+	}{
+		{"First Request", "/api/info", "203.0.113.7:5000", "", http.StatusBadRequest},
+		{"Second Request Limited", "/api/info", "203.0.113.7:6000", "", http.StatusTooManyRequests},
+		{"Health Check Not Limited", "/api/health", "203.0.113.7:5000", "", http.StatusOK},
+		{"Other Client", "/api/info", "203.0.113.8:5000", "", http.StatusBadRequest},
+		{"Client Behind Proxy", "/api/info", "127.0.0.1:5000", "198.51.100.1", http.StatusBadRequest},
+		{"Other Client Behind Proxy", "/api/info", "127.0.0.1:5000", "198.51.100.2", http.StatusBadRequest},
+		{"Same Client Behind Proxy Limited", "/api/info", "127.0.0.1:5001", "198.51.100.1", http.StatusTooManyRequests},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tc.path, nil)
+			req.RemoteAddr = tc.remoteAddr
+			if tc.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			if recorder.Code != tc.expectedStatus {
+				t.Errorf("Expected status code %d, got %d", tc.expectedStatus, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	cfg := config.Default()
+	cfg.MetricsEnabled = true
+	srv, baseURL, serveErr := startTestServer(t, cfg)
+	defer func() {
+		srv.Shutdown(context.Background())
+		<-serveErr
+	}()
+
+	img := new(bytes.Buffer)
+	png.Encode(img, image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("image", "test.png")
+	part.Write(img.Bytes())
+	writer.Close()
+
+	resp, err := http.Post(baseURL+"/api/resize?width=5", writer.FormDataContentType(), body)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	resp, err = http.Get(baseURL + "/api/nope/../../secret")
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	resp, err = http.Get(baseURL + "/metrics")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	exposition, _ := io.ReadAll(resp.Body)
+
+	for _, expected := range []string{
+		`image_service_http_requests_total{endpoint="resize",status="200"} 1`,
+		`image_service_http_request_duration_seconds_count{endpoint="resize",status="200"} 1`,
+		`image_service_http_request_size_bytes_count{endpoint="resize"} 1`,
+		`image_service_http_response_size_bytes_count{endpoint="resize"} 1`,
+		`image_service_http_requests_in_flight 0`,
+		`image_service_image_stage_duration_seconds_count{stage="decode"} 1`,
+		`image_service_image_stage_duration_seconds_count{stage="transform"} 1`,
+		`image_service_image_stage_duration_seconds_count{stage="encode"} 1`,
+		`image_service_source_images_total{format="png"} 1`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(string(exposition), expected) {
+			t.Errorf("Expected the metrics to contain %q", expected)
+		}
+	}
+	if strings.Contains(string(exposition), "secret") {
+		t.Error("Expected unknown paths to share the other endpoint label")
+	}
+}
+
+func TestMetricsDisabledByDefault(t *testing.T) {
+	srv, err := New(config.Default())
+	if err != nil {
+		t.Fatalf("Could not create server: %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, recorder.Code)
+	}
+}